@@ -0,0 +1,62 @@
+package wkhtmltox
+
+import (
+	"context"
+	"log"
+)
+
+// Backend converts the sections of a document to a pdf document.
+//
+// The package has two: CgoBackend calls libwkhtmltox in the process,
+// CommandBackend runs the wkhtmltopdf binary. Building with the wkhtmltox_nocgo tag,
+// or without cgo, drops CgoBackend and libwkhtmltox, and makes CommandBackend the default.
+type Backend interface {
+
+	// Convert converts the document described by job and returns the pdf data.
+	// If wkhtmltopdf fails to convert the document the error is a *ConversionError,
+	// the converter fills in the diagnostics reported with Job.Diagnostic.
+	//
+	// Convert calls job.Release once it no longer uses the files of the job,
+	// which is before it returns unless it returns because ctx is done.
+	Convert(ctx context.Context, job *Job) ([]byte, error)
+}
+
+// Job is a document to convert
+type Job struct {
+	Settings ConverterSettings
+	Sections []JobSection
+
+	// receive the diagnostics and progress of the conversion, one at a time and in order.
+	// Progress may be nil.
+	Diagnostic func(Diagnostic)
+	Progress   func(Progress)
+
+	// removes the temporary files of the job, e.g. the html of headers and footers
+	Release func()
+
+	// jobs with a higher priority are converted first by backends that queue jobs, e.g. Pool
+	Priority int
+}
+
+// JobSection is a section of a document
+type JobSection struct {
+	Settings SectionSettings
+
+	// the content of the section, nil if wkhtmltopdf loads it from the page setting
+	Html *string
+}
+
+// DefaultBackend is used by NewPdfConverter.
+// It's a *CgoBackend, or a *CommandBackend if the package is built without cgo.
+var DefaultBackend Backend = defaultBackend()
+
+// MustNewPdfConverterWithBackend is like NewPdfConverterWithBackend but panics if there's an error
+func MustNewPdfConverterWithBackend(backend Backend, settings ConverterSettings) Converter {
+
+	conv, err := NewPdfConverterWithBackend(backend, settings)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return conv
+}
@@ -0,0 +1,253 @@
+//go:build cgo && !wkhtmltox_nocgo
+
+package wkhtmltox
+
+import (
+	"context"
+	"github.com/nbosscher/wkhtmltox/wkhtmltoimage"
+	"github.com/nbosscher/wkhtmltox/wkhtmltopdf"
+)
+
+// CgoBackend converts documents with libwkhtmltox, on the render thread of the wkhtmltopdf package.
+// It's not available if the package is built with the wkhtmltox_nocgo tag or without cgo.
+type CgoBackend struct{}
+
+func defaultBackend() Backend {
+	return &CgoBackend{}
+}
+
+// Init initializes libwkhtmltox with options, which starts Qt.
+// Calling it is optional, the first conversion with CgoBackend or the image converter initializes it
+// with the default options. It returns ErrInitialized if libwkhtmltox is already initialized,
+// and ErrShutdown after Shutdown.
+func Init(options Options) error {
+
+	err := wkhtmltopdf.Init(wkhtmltopdf.Options{UseGraphics: options.UseGraphics})
+
+	switch err {
+	case wkhtmltopdf.ErrInitialized:
+		return ErrInitialized
+	case wkhtmltopdf.ErrShutdown:
+		return ErrShutdown
+	}
+
+	return err
+}
+
+// Shutdown waits for the running conversions and deinitializes libwkhtmltox.
+// Qt can't be initialized twice, so afterwards conversions that need libwkhtmltox return ErrShutdown.
+func Shutdown() {
+	wkhtmltopdf.Shutdown()
+}
+
+// Version returns the version of libwkhtmltox, e.g. to log it at startup. It doesn't initialize libwkhtmltox.
+func Version() string {
+	return wkhtmltopdf.Version()
+}
+
+// ExtendedQt reports whether libwkhtmltox is built against the patched Qt,
+// which e.g. headers, footers and the outline require
+func ExtendedQt() bool {
+	return wkhtmltopdf.ExtendedQt()
+}
+
+// Convert converts the document described by job.
+// libwkhtmltox can't interrupt a conversion that has started, so if ctx is done it's abandoned instead:
+// it runs to completion on the render thread, after which it's destroyed and job.Release is called.
+// Meanwhile it keeps the single render thread busy, so a page that hangs blocks later conversions;
+// use IsolatedBackend or Pool for cancellation that stops the conversion.
+// A conversion that Shutdown overtakes returns ErrShutdown.
+func (b *CgoBackend) Convert(ctx context.Context, job *Job) ([]byte, error) {
+
+	if wkhtmltopdf.IsShutdown() {
+		job.Release()
+		return nil, ErrShutdown
+	}
+
+	data, err := b.convert(ctx, job)
+	if err != nil {
+		return nil, shutdownError(err)
+	}
+
+	return data, nil
+}
+
+// shutdownError returns ErrShutdown instead of err if libwkhtmltox was shut down in the meantime:
+// a conversion takes several calls on the render thread, and those after Shutdown fail with errors of their own
+func shutdownError(err error) error {
+	if wkhtmltopdf.IsShutdown() {
+		return ErrShutdown
+	}
+
+	return err
+}
+
+func (b *CgoBackend) convert(ctx context.Context, job *Job) ([]byte, error) {
+
+	converter, err := newCgoConverter(job)
+	if err != nil {
+		job.Release()
+		return nil, err
+	}
+
+	// callbacks are invoked on the render thread in the order wkhtmltopdf reports them
+	converter.Warning = func(c *wkhtmltopdf.Converter, arg string) {
+		phase := c.CurrentPhase()
+		job.Diagnostic(newDiagnostic(SeverityWarning, arg, phase, c.PhaseDescription(phase)))
+	}
+
+	converter.Error = func(c *wkhtmltopdf.Converter, arg string) {
+		phase := c.CurrentPhase()
+		job.Diagnostic(newDiagnostic(SeverityError, arg, phase, c.PhaseDescription(phase)))
+	}
+
+	if job.Progress != nil {
+		converter.Phase = func(c *wkhtmltopdf.Converter) {
+			job.Progress(newProgress(c, 0))
+		}
+
+		converter.ProgressChanged = func(c *wkhtmltopdf.Converter, percent int) {
+			job.Progress(newProgress(c, percent))
+		}
+	}
+
+	status, err := converter.ConvertContext(ctx)
+	if err != nil {
+		// abandoned, Destroy waits for the render thread to be done with it
+		go func() {
+			converter.Destroy()
+			job.Release()
+		}()
+
+		return nil, err
+	}
+
+	defer job.Release()
+	defer converter.Destroy()
+
+	if !status {
+		return nil, &ConversionError{HttpErrorCode: converter.ErrorCode()}
+	}
+
+	return converter.OutputAsBuffer()
+}
+
+// newCgoConverter applies the settings of the job to a new converter and adds its sections
+func newCgoConverter(job *Job) (*wkhtmltopdf.Converter, error) {
+
+	set, ok := job.Settings.(*pdfConverterSettings)
+	if !ok {
+		return nil, ErrForeignSettings
+	}
+
+	global := wkhtmltopdf.NewGlobalSettings()
+
+	err := applyTo(set.values.flatten(packageGlobalSettings), global.Set)
+	if err != nil {
+		return nil, err
+	}
+
+	// the converter takes ownership of the settings
+	converter := global.NewConverter()
+
+	for _, section := range job.Sections {
+		s, ok := section.Settings.(*sectionSettings)
+		if !ok {
+			converter.Destroy()
+			return nil, ErrForeignSettings
+		}
+
+		object := wkhtmltopdf.NewObjectSettings()
+
+		err = applyTo(s.values.flatten(packageObjectSettings), object.Set)
+		if err != nil {
+			converter.Destroy()
+			return nil, err
+		}
+
+		if section.Html == nil {
+			converter.Add(object)
+		} else {
+			converter.AddHtml(object, *section.Html)
+		}
+	}
+
+	return converter, nil
+}
+
+func newProgress(c *wkhtmltopdf.Converter, percent int) Progress {
+	phase := c.CurrentPhase()
+
+	return Progress{
+		Percent:          percent,
+		Phase:            phase,
+		PhaseCount:       c.PhaseCount(),
+		PhaseDescription: c.PhaseDescription(phase),
+	}
+}
+
+// convertImage renders the page with libwkhtmltoimage
+func convertImage(ctx context.Context, set *imageConverterSettings, html string) (*Result, error) {
+
+	if wkhtmltopdf.IsShutdown() {
+		return nil, ErrShutdown
+	}
+
+	result, err := renderImage(ctx, set, html)
+	if err != nil {
+		return nil, shutdownError(err)
+	}
+
+	return result, nil
+}
+
+func renderImage(ctx context.Context, set *imageConverterSettings, html string) (*Result, error) {
+
+	settings := wkhtmltoimage.NewGlobalSettings()
+
+	err := applyTo(set.values.flatten(packageImageSettings), settings.Set)
+	if err != nil {
+		return nil, err
+	}
+
+	converter := settings.NewConverter(html)
+
+	// callbacks are invoked on the render thread in the order wkhtmltoimage reports them
+	diagnostics := &diagnosticList{policy: set.warningPolicy}
+
+	converter.Warning = func(c *wkhtmltoimage.Converter, arg string) {
+		phase := c.CurrentPhase()
+		diagnostics.add(newDiagnostic(SeverityWarning, arg, phase, c.PhaseDescription(phase)))
+	}
+
+	converter.Error = func(c *wkhtmltoimage.Converter, arg string) {
+		phase := c.CurrentPhase()
+		diagnostics.add(newDiagnostic(SeverityError, arg, phase, c.PhaseDescription(phase)))
+	}
+
+	status, err := converter.ConvertContext(ctx)
+	if err != nil {
+		// abandoned, Destroy waits for the render thread to be done with it
+		go converter.Destroy()
+		return nil, err
+	}
+
+	defer converter.Destroy()
+
+	if !status || diagnostics.failed {
+		return nil, &ConversionError{
+			Diagnostics:   diagnostics.list,
+			HttpErrorCode: converter.ErrorCode(),
+		}
+	}
+
+	data, err := converter.OutputAsBuffer()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Data:        data,
+		Diagnostics: diagnostics.list,
+	}, nil
+}
@@ -0,0 +1,327 @@
+//go:build cgo && !wkhtmltox_nocgo
+
+package wkhtmltox
+
+import (
+	"fmt"
+	"github.com/nbosscher/wkhtmltox/wkhtmltopdf"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewImageConverter(t *testing.T) {
+
+	settings := NewImageConverterSettings()
+	settings.SetFormat(ImageFormatJpeg)
+	settings.SetQuality(80)
+	settings.SetScreenWidth(800)
+	settings.SetCrop(&CropSetting{Width: 400, Height: 300})
+
+	conv := MustNewImageConverter(settings)
+	Must(conv.SetHtml("<html><body><h1>Hello world</h1></body></html>"))
+
+	data, err := conv.Convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) == 0 {
+		t.Fatal("expecting image data")
+	}
+}
+
+func TestCgoBackend_GlobalSettings_Orientation(t *testing.T) {
+
+	value := "Landscape"
+
+	set := wkhtmltopdf.NewGlobalSettings()
+	err := set.Set("orientation", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz, err := set.Get("orientation")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz != value {
+		t.Fatal("expecting", value, "got", sz)
+	}
+}
+
+func TestCgoBackend_GlobalSettings_ViewPortSize(t *testing.T) {
+
+	value := "1280x800"
+
+	set := wkhtmltopdf.NewGlobalSettings()
+	err := set.Set("viewportSize", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz, err := set.Get("viewportSize")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz != value {
+		t.Fatal("expecting", value, "got", sz)
+	}
+}
+
+func TestCgoBackend_GlobalSettings_LongValues(t *testing.T) {
+
+	// multi-byte characters, around and far beyond the initial buffer size
+	values := []string{
+		strings.Repeat("a", 255),
+		strings.Repeat("ü", 128),
+		strings.Repeat("Jahresbericht 年度报告 ", 200),
+	}
+
+	for _, value := range values {
+
+		set := wkhtmltopdf.NewGlobalSettings()
+
+		for _, key := range []string{"documentTitle", "load.cookieJar", "dumpOutline"} {
+			err := set.Set(key, value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := set.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != value {
+				t.Fatal(key+": expecting", len(value), "bytes, got", len(got))
+			}
+		}
+	}
+}
+
+func TestCgoBackend_Convert(t *testing.T) {
+
+	// the package's own settings must be accepted by libwkhtmltox
+	conv := MustNewPdfConverterWithBackend(&CgoBackend{}, nil)
+	Must(conv.AddHtml("<h1>Hello world</h1>", nil))
+
+	data, err := conv.Convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(data), "%PDF") {
+		t.Fatal("expecting pdf data")
+	}
+}
+
+func TestCgoBackend_ConcurrentConverters(t *testing.T) {
+
+	// every callback must reach the converter it was set on, run with -race
+	const count = 32
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			converter := wkhtmltopdf.NewGlobalSettings().NewConverter()
+			converter.AddHtml(wkhtmltopdf.NewObjectSettings(), fmt.Sprintf("<h1>converter %d</h1>", i))
+
+			defer converter.Destroy()
+
+			foreign, finished, progress := 0, 0, 0
+
+			converter.Phase = func(c *wkhtmltopdf.Converter) {
+				if c != converter {
+					foreign++
+				}
+			}
+
+			converter.ProgressChanged = func(c *wkhtmltopdf.Converter, percent int) {
+				if c != converter {
+					foreign++
+				}
+
+				progress++
+			}
+
+			converter.Finished = func(c *wkhtmltopdf.Converter, status int) {
+				if c != converter {
+					foreign++
+				}
+
+				finished++
+			}
+
+			if !converter.Convert() {
+				errs <- fmt.Errorf("converter %d: conversion failed", i)
+				return
+			}
+
+			data, err := converter.OutputAsBuffer()
+
+			switch {
+			case err != nil:
+				errs <- fmt.Errorf("converter %d: %v", i, err)
+			case !strings.HasPrefix(string(data), "%PDF"):
+				errs <- fmt.Errorf("converter %d: expecting pdf data", i)
+			case foreign != 0:
+				errs <- fmt.Errorf("converter %d: got %d callbacks of other converters", i, foreign)
+			case finished != 1 || progress == 0:
+				errs <- fmt.Errorf("converter %d: got %d finished and %d progress callbacks", i, finished, progress)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+
+	if Version() == "" {
+		t.Fatal("expecting a version")
+	}
+
+	t.Log("libwkhtmltox", Version(), "extended qt:", ExtendedQt())
+}
+
+func TestInitShutdown(t *testing.T) {
+
+	// Shutdown is final for the process, so the test runs in a child
+	if os.Getenv("WKHTMLTOX_TEST_SHUTDOWN") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInitShutdown$")
+		cmd.Env = append(os.Environ(), "WKHTMLTOX_TEST_SHUTDOWN=1")
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(err, string(out))
+		}
+
+		return
+	}
+
+	// importing the package doesn't initialize libwkhtmltox
+	err := Init(Options{UseGraphics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Init(Options{})
+	if err != ErrInitialized {
+		t.Fatal("expecting", ErrInitialized, "got", err)
+	}
+
+	conv := MustNewPdfConverter(nil)
+	Must(conv.AddHtml("<h1>Hello world</h1>", nil))
+
+	_, err = conv.Convert()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Shutdown()
+	Shutdown()
+
+	conv = MustNewPdfConverter(nil)
+	Must(conv.AddHtml("<h1>Hello world</h1>", nil))
+
+	_, err = conv.Convert()
+	if err != ErrShutdown {
+		t.Fatal("expecting", ErrShutdown, "got", err)
+	}
+
+	image := MustNewImageConverter(nil)
+	Must(image.SetHtml("<h1>Hello world</h1>"))
+
+	_, err = image.Convert()
+	if err != ErrShutdown {
+		t.Fatal("expecting", ErrShutdown, "got", err)
+	}
+
+	err = Init(Options{})
+	if err != ErrShutdown {
+		t.Fatal("expecting", ErrShutdown, "got", err)
+	}
+}
+
+func TestShutdown_Concurrent(t *testing.T) {
+
+	if os.Getenv("WKHTMLTOX_TEST_SHUTDOWN") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestShutdown_Concurrent$")
+		cmd.Env = append(os.Environ(), "WKHTMLTOX_TEST_SHUTDOWN=1")
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(err, string(out))
+		}
+
+		return
+	}
+
+	// conversions racing with Shutdown either complete or return ErrShutdown
+	const count = 16
+
+	wg := sync.WaitGroup{}
+	started := make(chan struct{}, count)
+	errs := make(chan error, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for n := 0; ; n++ {
+				var err error
+
+				if n%2 == 0 {
+					conv := MustNewPdfConverter(nil)
+					Must(conv.AddHtml(fmt.Sprintf("<h1>converter %d</h1>", i), nil))
+					_, err = conv.Convert()
+				} else {
+					image := MustNewImageConverter(nil)
+					Must(image.SetHtml(fmt.Sprintf("<h1>converter %d</h1>", i)))
+					_, err = image.Convert()
+				}
+
+				if n == 0 {
+					started <- struct{}{}
+				}
+
+				switch err {
+				case nil:
+				case ErrShutdown:
+					return
+				default:
+					errs <- fmt.Errorf("converter %d: expecting nil or %v, got %v", i, ErrShutdown, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	<-started
+	Shutdown()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,390 @@
+package wkhtmltox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommandBackend converts documents by running the wkhtmltopdf command line tool.
+// The settings are passed as command line options, the pdf document is read from its standard output,
+// and the diagnostics and progress from its standard error.
+// If ctx is done the process is killed.
+type CommandBackend struct {
+
+	// the path of the wkhtmltopdf binary, "wkhtmltopdf" is looked up in PATH if it's empty
+	Path string
+}
+
+// commandOption maps a setting to a wkhtmltopdf command line option
+type commandOption struct {
+	key string
+
+	// the option followed by the value, e.g. --page-size A4
+	option string
+
+	// or the options of a bool setting, skipped if empty
+	on, off string
+}
+
+// see wkhtmltopdf --extended-help
+var globalCommandOptions = []commandOption{
+	{key: "size.paperSize", option: "--page-size"},
+	{key: "size.width", option: "--page-width"},
+	{key: "size.height", option: "--page-height"},
+	{key: "orientation", option: "--orientation"},
+	{key: "dpi", option: "--dpi"},
+	{key: "pageOffset", option: "--page-offset"},
+	{key: "copies", option: "--copies"},
+	{key: "collate", on: "--collate", off: "--no-collate"},
+	{key: "outline", on: "--outline", off: "--no-outline"},
+	{key: "outlineDepth", option: "--outline-depth"},
+	{key: "dumpOutline", option: "--dump-outline"},
+	{key: "documentTitle", option: "--title"},
+	{key: "useCompression", off: "--no-pdf-compression"},
+	{key: "margin.top", option: "--margin-top"},
+	{key: "margin.bottom", option: "--margin-bottom"},
+	{key: "margin.left", option: "--margin-left"},
+	{key: "margin.right", option: "--margin-right"},
+	{key: "imageDPI", option: "--image-dpi"},
+	{key: "imageQuality", option: "--image-quality"},
+	{key: "load.cookieJar", option: "--cookie-jar"},
+	{key: "viewportSize", option: "--viewport-size"},
+}
+
+var objectCommandOptions = []commandOption{
+	{key: "web.enableJavascript", on: "--enable-javascript", off: "--disable-javascript"},
+	{key: "load.jsdelay", option: "--javascript-delay"},
+	{key: "load.debugJavascript", on: "--debug-javascript", off: "--no-debug-javascript"},
+	{key: "web.loadImages", on: "--images", off: "--no-images"},
+	{key: "web.enableIntelligentShrinking", on: "--enable-smart-shrinking", off: "--disable-smart-shrinking"},
+	{key: "web.printMediaType", on: "--print-media-type", off: "--no-print-media-type"},
+	{key: "web.defaultEncoding", option: "--encoding"},
+	{key: "web.background", on: "--background", off: "--no-background"},
+	{key: "web.minimumFontSize", option: "--minimum-font-size"},
+	{key: "web.userStyleSheet", option: "--user-style-sheet"},
+	{key: "web.enablePlugins", on: "--enable-plugins", off: "--disable-plugins"},
+	{key: "load.blockLocalFileAccess", on: "--disable-local-file-access", off: "--enable-local-file-access"},
+	{key: "load.loadErrorHandling", option: "--load-error-handling"},
+	{key: "load.zoomFactor", option: "--zoom"},
+	{key: "load.username", option: "--username"},
+	{key: "load.password", option: "--password"},
+	{key: "load.repeatCustomHeaders", on: "--custom-header-propagation", off: "--no-custom-header-propagation"},
+	{key: "load.proxy", option: "--proxy"},
+	{key: "load.windowStatus", option: "--window-status"},
+	{key: "load.stopSlowScript", on: "--stop-slow-scripts", off: "--no-stop-slow-scripts"},
+	{key: "header.fontSize", option: "--header-font-size"},
+	{key: "header.fontName", option: "--header-font-name"},
+	{key: "header.left", option: "--header-left"},
+	{key: "header.center", option: "--header-center"},
+	{key: "header.right", option: "--header-right"},
+	{key: "header.line", on: "--header-line", off: "--no-header-line"},
+	{key: "header.spacing", option: "--header-spacing"},
+	{key: "header.htmlUrl", option: "--header-html"},
+	{key: "footer.fontSize", option: "--footer-font-size"},
+	{key: "footer.fontName", option: "--footer-font-name"},
+	{key: "footer.left", option: "--footer-left"},
+	{key: "footer.center", option: "--footer-center"},
+	{key: "footer.right", option: "--footer-right"},
+	{key: "footer.line", on: "--footer-line", off: "--no-footer-line"},
+	{key: "footer.spacing", option: "--footer-spacing"},
+	{key: "footer.htmlUrl", option: "--footer-html"},
+	{key: "useExternalLinks", on: "--enable-external-links", off: "--disable-external-links"},
+	{key: "useLocalLinks", on: "--enable-internal-links", off: "--disable-internal-links"},
+	{key: "produceForms", on: "--enable-forms", off: "--disable-forms"},
+	{key: "includeInOutline", on: "--include-in-outline", off: "--exclude-from-outline"},
+	{key: "toc.backLinks", on: "--enable-toc-back-links", off: "--disable-toc-back-links"},
+}
+
+// the options only a table of contents accepts
+var tocCommandOptions = []commandOption{
+	{key: "toc.captionText", option: "--toc-header-text"},
+	{key: "toc.useDottedLines", off: "--disable-dotted-lines"},
+	{key: "toc.forwardLinks", off: "--disable-toc-links"},
+	{key: "toc.indentation", option: "--toc-level-indentation"},
+	{key: "toc.fontScale", option: "--toc-text-size-shrink"},
+	{key: "tocXsl", option: "--xsl-style-sheet"},
+}
+
+// the list settings of a section, every item is passed as the option followed by its fields
+var listCommandOptions = []struct {
+	key    string
+	option string
+	fields []string
+}{
+	{key: "load.customHeaders", option: "--custom-header", fields: []string{"first", "second"}},
+	{key: "load.post", option: "--post", fields: []string{"name", "value"}},
+	{key: "load.cookies", option: "--cookie", fields: []string{"first", "second"}},
+	{key: "load.runScript", option: "--run-script", fields: []string{""}},
+}
+
+// how long to wait for the output of wkhtmltopdf once it exited or was killed
+const commandWaitDelay = time.Second
+
+var (
+	commandPhasePattern    = regexp.MustCompile(`^(.+) \((\d+)/(\d+)\)$`)
+	commandProgressPattern = regexp.MustCompile(`(\d+)%$`)
+	commandHttpErrPattern  = regexp.MustCompile(`due to http error: (\d+)`)
+)
+
+// Convert runs wkhtmltopdf with the settings and sections of job and returns its output
+func (b *CommandBackend) Convert(ctx context.Context, job *Job) ([]byte, error) {
+
+	defer job.Release()
+
+	dir, err := ioutil.TempDir("", "wkhtmltox-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	args, err := commandArgs(job, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	path := b.Path
+	if path == "" {
+		path = "wkhtmltopdf"
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr, stderrWriter := io.Pipe()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderrWriter
+
+	// don't wait for processes wkhtmltopdf started and that hold on to its output once it's killed
+	cmd.WaitDelay = commandWaitDelay
+
+	output := make(chan commandOutput, 1)
+
+	go func() {
+		output <- readCommandOutput(stderr, job)
+	}()
+
+	err = cmd.Start()
+	if err == nil {
+		err = cmd.Wait()
+	}
+
+	stderrWriter.Close()
+	out := <-output
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+
+		// wkhtmltopdf also exits with 1 for problems it recovers from, e.g. a resource of the page that fails to load,
+		// and still writes the pdf document. The exit is then reported as a warning, subject to the WarningPolicy.
+		if !bytes.HasPrefix(stdout.Bytes(), []byte("%PDF")) {
+			return nil, &ConversionError{HttpErrorCode: out.httpErrorCode}
+		}
+
+		message := fmt.Sprintf("wkhtmltopdf exited with code %d", exitErr.ExitCode())
+		if out.httpErrorCode != 0 {
+			message += fmt.Sprintf(" due to http error %d", out.httpErrorCode)
+		}
+
+		job.Diagnostic(newDiagnostic(SeverityWarning, message, out.progress.Phase, out.progress.PhaseDescription))
+
+		return stdout.Bytes(), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// commandOutput is what readCommandOutput keeps of the output of wkhtmltopdf
+type commandOutput struct {
+
+	// the http error code wkhtmltopdf exits with, or 0
+	httpErrorCode int
+
+	// the last progress reported
+	progress Progress
+}
+
+// readCommandOutput reports the progress and diagnostics wkhtmltopdf writes to stderr
+func readCommandOutput(r io.Reader, job *Job) commandOutput {
+
+	httpErrorCode := 0
+	progress := Progress{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanCommandLines)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "Warning:") {
+			message := strings.TrimSpace(strings.TrimPrefix(line, "Warning:"))
+			job.Diagnostic(newDiagnostic(SeverityWarning, message, progress.Phase, progress.PhaseDescription))
+
+			continue
+		}
+
+		if strings.HasPrefix(line, "Error:") {
+			message := strings.TrimSpace(strings.TrimPrefix(line, "Error:"))
+			job.Diagnostic(newDiagnostic(SeverityError, message, progress.Phase, progress.PhaseDescription))
+
+			continue
+		}
+
+		if m := commandPhasePattern.FindStringSubmatch(line); m != nil {
+			progress = Progress{
+				Phase:            parseInt(m[2]) - 1,
+				PhaseCount:       parseInt(m[3]),
+				PhaseDescription: m[1],
+			}
+
+			if job.Progress != nil {
+				job.Progress(progress)
+			}
+
+			continue
+		}
+
+		if m := commandProgressPattern.FindStringSubmatch(line); m != nil && strings.HasPrefix(line, "[") {
+			progress.Percent = parseInt(m[1])
+
+			if job.Progress != nil {
+				job.Progress(progress)
+			}
+
+			continue
+		}
+
+		if m := commandHttpErrPattern.FindStringSubmatch(line); m != nil {
+			httpErrorCode = parseInt(m[1])
+		}
+	}
+
+	// the process may still be writing, wkhtmltopdf blocks once the pipe is full
+	io.Copy(ioutil.Discard, r)
+
+	return commandOutput{httpErrorCode: httpErrorCode, progress: progress}
+}
+
+// scanCommandLines splits the output at '\n' and '\r', wkhtmltopdf redraws its progress bar with '\r'
+func scanCommandLines(data []byte, atEOF bool) (int, []byte, error) {
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
+
+// commandArgs returns the command line that converts job, html sections are written to files in dir
+func commandArgs(job *Job, dir string) ([]string, error) {
+
+	set, ok := job.Settings.(*pdfConverterSettings)
+	if !ok {
+		return nil, ErrForeignSettings
+	}
+
+	global := commandValues(set.values, packageGlobalSettings)
+
+	args := commandOptions(globalCommandOptions, global)
+
+	if global["colorMode"] == string(ColorModeGrayScale) {
+		args = append(args, "--grayscale")
+	}
+
+	for i, section := range job.Sections {
+		s, ok := section.Settings.(*sectionSettings)
+		if !ok {
+			return nil, ErrForeignSettings
+		}
+
+		object := commandValues(s.values, packageObjectSettings)
+
+		if parseBool(object["isTableOfContent"]) {
+			args = append(args, "toc")
+			args = append(args, commandOptions(tocCommandOptions, object)...)
+		} else {
+			page := object["page"]
+
+			if section.Html != nil {
+				page = filepath.Join(dir, "section-"+strconv.Itoa(i)+".html")
+
+				err := ioutil.WriteFile(page, []byte(*section.Html), 0600)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			args = append(args, "page", page)
+		}
+
+		args = append(args, commandOptions(objectCommandOptions, object)...)
+
+		for _, l := range listCommandOptions {
+			for _, item := range s.getList(l.key, l.fields...) {
+				args = append(append(args, l.option), item...)
+			}
+		}
+	}
+
+	return append(args, "-"), nil
+}
+
+// commandValues returns the value of every setting applied by pkg or a setter
+func commandValues(values settingValues, pkg []settingValue) map[string]string {
+
+	m := map[string]string{}
+
+	for _, s := range values.flatten(pkg) {
+		m[s.key] = s.value
+	}
+
+	return m
+}
+
+// commandOptions returns the options of the settings that are set in values
+func commandOptions(options []commandOption, values map[string]string) []string {
+
+	args := []string{}
+
+	for _, o := range options {
+		value, ok := values[o.key]
+		if !ok || value == "" {
+			continue
+		}
+
+		switch {
+		case o.option != "":
+			args = append(args, o.option, value)
+		case parseBool(value) && o.on != "":
+			args = append(args, o.on)
+		case !parseBool(value) && o.off != "":
+			args = append(args, o.off)
+		}
+	}
+
+	return args
+}
@@ -0,0 +1,693 @@
+package wkhtmltox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the hidden subcommand that runs a conversion for an IsolatedBackend
+const isolatedCommand = "wkhtmltox-isolated-child"
+
+// the version of the protocol spoken over the stdin and stdout of the child.
+// Parent and child are the same binary, the version guards against a binary replaced on disk while it's running.
+const isolatedProtocolVersion = 1
+
+// the frames of the protocol: a kind byte, the big endian uint32 length of the payload, and the payload.
+// Both sides start with a hello frame holding the magic and version, the parent then sends job frames one at a time.
+// The child replies to each with diagnostic and progress frames, followed by either a result or an error frame,
+// and exits once its stdin is closed.
+const (
+	isolatedFrameHello      byte = 'H'
+	isolatedFrameJob        byte = 'J'
+	isolatedFrameDiagnostic byte = 'D'
+	isolatedFrameProgress   byte = 'P'
+	isolatedFrameResult     byte = 'R'
+	isolatedFrameError      byte = 'E'
+)
+
+const isolatedMagic = "wkhtmltox"
+
+// frames larger than this are a protocol error rather than an allocation
+const isolatedMaxFrame = 1 << 30
+
+// the output of the child kept for ChildError
+const isolatedStderrTail = 4096
+
+// returned by IsolatedBackend when the conversion takes longer than its Timeout
+var ErrIsolatedTimeout = errors.New("wkhtmltox: the isolated conversion timed out, the child process was killed")
+
+// ChildError is returned by IsolatedBackend when the child process crashes,
+// exits or breaks the protocol before it returns the result of the conversion
+type ChildError struct {
+
+	// how the child ended, e.g. "signal: segmentation fault" or "exit status 1"
+	State string
+
+	// whether or not the child was terminated by a signal the parent didn't send, e.g. a crash in libwkhtmltox.
+	// A child that breaks the protocol is killed, which isn't a crash.
+	Crashed bool
+
+	// the end of what the child wrote to stderr
+	Stderr string
+
+	// the protocol error, if any
+	Err error
+}
+
+func (e *ChildError) Error() string {
+
+	msg := "wkhtmltox: isolated child failed"
+
+	if e.State != "" {
+		msg += ": " + e.State
+	}
+
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	if e.Stderr != "" {
+		msg += "\n" + e.Stderr
+	}
+
+	return msg
+}
+
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+// IsolatedBackend converts documents in a child process, so a crash of libwkhtmltox can't take down the process.
+//
+// The child is the same binary started with a hidden subcommand, which is handled by this package's init function
+// before main runs. It converts the document with the default backend, i.e. libwkhtmltox if the binary is built with cgo.
+// The job and its result are passed over stdin and stdout, the child must not write anything else to stdout.
+type IsolatedBackend struct {
+
+	// the path of the binary to run, the current executable if it's empty
+	Path string
+
+	// how long a conversion may take before the child is killed, no limit if 0
+	Timeout time.Duration
+}
+
+func init() {
+	if len(os.Args) > 1 && os.Args[1] == isolatedCommand {
+		os.Exit(serveIsolated(os.Stdin, os.Stdout))
+	}
+}
+
+// isolatedSetting is a settingValue on the wire
+type isolatedSetting struct {
+	Key   string            `json:"key"`
+	Value string            `json:"value,omitempty"`
+	List  []isolatedSetting `json:"list,omitempty"`
+}
+
+type isolatedJob struct {
+	Settings []isolatedSetting `json:"settings"`
+	Sections []isolatedSection `json:"sections"`
+}
+
+type isolatedSection struct {
+	Settings []isolatedSetting `json:"settings"`
+	Html     *string           `json:"html,omitempty"`
+}
+
+// isolatedError is an error of the conversion on the wire
+type isolatedError struct {
+	Message string `json:"message"`
+
+	// set if the error is a *ConversionError
+	Conversion    bool `json:"conversion,omitempty"`
+	HttpErrorCode int  `json:"httpErrorCode,omitempty"`
+}
+
+// Convert converts the document described by job in a new child process
+func (b *IsolatedBackend) Convert(ctx context.Context, job *Job) ([]byte, error) {
+
+	defer job.Release()
+
+	w := &isolatedWorker{path: b.Path}
+	defer w.stop()
+
+	return w.convert(ctx, job, b.Timeout)
+}
+
+// isolatedWorker is a child process that converts jobs one at a time.
+// The child is started by the first job, and again after it's killed or crashed.
+type isolatedWorker struct {
+	path string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *io.PipeReader
+	stderr *tailBuffer
+
+	// closed once the child is gone and its output is read, cmd.ProcessState is set afterwards
+	exited chan struct{}
+
+	// the jobs converted by the current child
+	jobs int
+}
+
+func (w *isolatedWorker) running() bool {
+	return w.cmd != nil
+}
+
+func (w *isolatedWorker) start() error {
+
+	path := w.path
+	if path == "" {
+		var err error
+
+		path, err = os.Executable()
+		if err != nil {
+			return err
+		}
+	}
+
+	stdout, stdoutWriter := io.Pipe()
+	stderr := &tailBuffer{max: isolatedStderrTail}
+
+	cmd := exec.Command(path, isolatedCommand)
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderr
+
+	// don't wait for processes the child started and that hold on to its output once it's gone
+	cmd.WaitDelay = commandWaitDelay
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+
+	go func() {
+		cmd.Wait()
+		stdoutWriter.Close()
+		close(exited)
+	}()
+
+	*w = isolatedWorker{
+		path:   w.path,
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		exited: exited,
+	}
+
+	return nil
+}
+
+// convert sends job to the child and returns its reply.
+// If the child doesn't reply before ctx is done, or before timeout if it's not 0, it's killed.
+func (w *isolatedWorker) convert(ctx context.Context, job *Job, timeout time.Duration) ([]byte, error) {
+
+	payload, err := encodeIsolatedJob(job)
+	if err != nil {
+		return nil, err
+	}
+
+	first := !w.running()
+
+	if first {
+		err = w.start()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	childCtx := ctx
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		childCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type response struct {
+		data []byte
+		err  error
+
+		// whether or not the child replied with a result or an error
+		done bool
+	}
+
+	responses := make(chan response, 1)
+
+	go func() {
+		out := &frameWriter{w: w.stdin}
+
+		if first {
+			out.write(isolatedFrameHello, isolatedHello())
+		}
+
+		// a child that's gone fails the write, which is reported by reading its reply
+		out.write(isolatedFrameJob, payload)
+
+		if first {
+			err := readIsolatedHello(w.stdout)
+			if err != nil {
+				responses <- response{err: err}
+				return
+			}
+		}
+
+		data, done, err := readIsolatedResponse(w.stdout, job)
+		responses <- response{data: data, err: err, done: done}
+	}()
+
+	var r response
+
+	select {
+	case r = <-responses:
+	case <-childCtx.Done():
+		w.kill()
+		<-responses
+
+		w.cmd = nil
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, ErrIsolatedTimeout
+	}
+
+	if r.done {
+		w.jobs++
+		return r.data, r.err
+	}
+
+	// the child crashed, exited or broke the protocol, in which case it's still running and killed.
+	// Its output ends only once it's gone, so it's waited for then.
+	killed := false
+
+	if r.err == io.EOF || r.err == io.ErrUnexpectedEOF {
+		<-w.exited
+	} else {
+		select {
+		case <-w.exited:
+		default:
+			killed = true
+			w.kill()
+		}
+	}
+
+	childErr := &ChildError{
+		State:   w.cmd.ProcessState.String(),
+		Crashed: !killed && !w.cmd.ProcessState.Exited(),
+		Stderr:  strings.TrimSpace(w.stderr.String()),
+		Err:     r.err,
+	}
+
+	if childErr.Err == nil || childErr.Err == io.EOF {
+		childErr.Err = errors.New("exited without a result")
+	}
+
+	w.cmd = nil
+
+	return nil, childErr
+}
+
+// kill kills the child and waits for it to be gone.
+// Its unread output is discarded, so copying it doesn't block the wait.
+func (w *isolatedWorker) kill() {
+	w.cmd.Process.Kill()
+	w.stdout.Close()
+	<-w.exited
+}
+
+// stop asks the child to exit by closing its stdin, and kills it if it doesn't in time
+func (w *isolatedWorker) stop() {
+
+	if !w.running() {
+		return
+	}
+
+	process := w.cmd.Process
+	w.stdin.Close()
+
+	timer := time.AfterFunc(commandWaitDelay, func() {
+		process.Kill()
+	})
+
+	<-w.exited
+	timer.Stop()
+
+	w.cmd = nil
+}
+
+// rss returns the resident set size of the child in bytes, or 0 if it's not known.
+// It's read from /proc, so it's only known on linux.
+func (w *isolatedWorker) rss() int64 {
+
+	if !w.running() {
+		return 0
+	}
+
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(w.cmd.Process.Pid) + "/status")
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "VmRSS:") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return 0
+			}
+
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+
+	return 0
+}
+
+// readIsolatedResponse reads the frames the child replies to a job with, forwarding diagnostics and progress to job.
+// done is false if the child didn't reply with a result or an error.
+func readIsolatedResponse(r io.Reader, job *Job) (data []byte, done bool, err error) {
+
+	for {
+		kind, payload, err := readFrame(r)
+		if err != nil {
+			return nil, false, err
+		}
+
+		switch kind {
+		case isolatedFrameDiagnostic:
+			d := Diagnostic{}
+
+			err = json.Unmarshal(payload, &d)
+			if err != nil {
+				return nil, false, err
+			}
+
+			job.Diagnostic(d)
+
+		case isolatedFrameProgress:
+			p := Progress{}
+
+			err = json.Unmarshal(payload, &p)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if job.Progress != nil {
+				job.Progress(p)
+			}
+
+		case isolatedFrameResult:
+			return payload, true, nil
+
+		case isolatedFrameError:
+			e := isolatedError{}
+
+			err = json.Unmarshal(payload, &e)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if e.Conversion {
+				return nil, true, &ConversionError{HttpErrorCode: e.HttpErrorCode}
+			}
+
+			return nil, true, errors.New(e.Message)
+
+		default:
+			return nil, false, fmt.Errorf("unexpected frame '%c'", kind)
+		}
+	}
+}
+
+// serveIsolated runs the conversions the parent sends on r, replying on w, until r is closed.
+// It returns the exit code of the child.
+func serveIsolated(r io.Reader, w io.Writer) int {
+
+	out := &frameWriter{w: w}
+
+	if out.write(isolatedFrameHello, isolatedHello()) != nil {
+		return 2
+	}
+
+	err := readIsolatedHello(r)
+	if err != nil {
+		out.writeError(err)
+		return 2
+	}
+
+	for {
+		kind, payload, err := readFrame(r)
+		if err == io.EOF {
+			return 0
+		}
+
+		if err == nil && kind != isolatedFrameJob {
+			err = fmt.Errorf("unexpected frame '%c'", kind)
+		}
+
+		if err != nil {
+			out.writeError(err)
+			return 2
+		}
+
+		job, err := decodeIsolatedJob(payload)
+		if err != nil {
+			out.writeError(err)
+			return 2
+		}
+
+		job.Diagnostic = func(d Diagnostic) {
+			out.writeJson(isolatedFrameDiagnostic, d)
+		}
+
+		job.Progress = func(p Progress) {
+			out.writeJson(isolatedFrameProgress, p)
+		}
+
+		data, err := defaultBackend().Convert(context.Background(), job)
+		if err != nil {
+			out.writeError(err)
+		} else {
+			out.write(isolatedFrameResult, data)
+		}
+
+		if out.err != nil {
+			return 2
+		}
+	}
+}
+
+func isolatedHello() []byte {
+	return append([]byte(isolatedMagic), isolatedProtocolVersion)
+}
+
+func readIsolatedHello(r io.Reader) error {
+
+	kind, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+
+	if kind != isolatedFrameHello || !bytes.HasPrefix(payload, []byte(isolatedMagic)) || len(payload) != len(isolatedMagic)+1 {
+		return errors.New("not a wkhtmltox child, missing hello")
+	}
+
+	if version := payload[len(isolatedMagic)]; version != isolatedProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, expecting %d", version, isolatedProtocolVersion)
+	}
+
+	return nil
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > isolatedMaxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too large", n)
+	}
+
+	payload := make([]byte, n)
+
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return header[0], payload, err
+}
+
+// frameWriter writes frames, keeping the first error.
+// Callbacks of the conversion may write from another go-routine than the one that writes the result.
+type frameWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (f *frameWriter) write(kind byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	_, f.err = f.w.Write(append(header, payload...))
+
+	return f.err
+}
+
+func (f *frameWriter) writeJson(kind byte, v interface{}) error {
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return f.write(kind, payload)
+}
+
+func (f *frameWriter) writeError(err error) error {
+
+	e := isolatedError{Message: err.Error()}
+
+	var conversionErr *ConversionError
+	if errors.As(err, &conversionErr) {
+		e.Conversion = true
+		e.HttpErrorCode = conversionErr.HttpErrorCode
+	}
+
+	return f.writeJson(isolatedFrameError, e)
+}
+
+// encodeIsolatedJob returns the payload of the job frame
+func encodeIsolatedJob(job *Job) ([]byte, error) {
+
+	set, ok := job.Settings.(*pdfConverterSettings)
+	if !ok {
+		return nil, ErrForeignSettings
+	}
+
+	j := isolatedJob{Settings: encodeSettings(set.values.list)}
+
+	for _, section := range job.Sections {
+		s, ok := section.Settings.(*sectionSettings)
+		if !ok {
+			return nil, ErrForeignSettings
+		}
+
+		j.Sections = append(j.Sections, isolatedSection{
+			Settings: encodeSettings(s.values.list),
+			Html:     section.Html,
+		})
+	}
+
+	return json.Marshal(j)
+}
+
+func decodeIsolatedJob(payload []byte) (*Job, error) {
+
+	j := isolatedJob{}
+
+	err := json.Unmarshal(payload, &j)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		Settings: &pdfConverterSettings{values: settingValues{list: decodeSettings(j.Settings)}},
+		Release:  func() {},
+	}
+
+	for _, section := range j.Sections {
+		job.Sections = append(job.Sections, JobSection{
+			Settings: &sectionSettings{values: settingValues{list: decodeSettings(section.Settings)}},
+			Html:     section.Html,
+		})
+	}
+
+	return job, nil
+}
+
+func encodeSettings(list []settingValue) []isolatedSetting {
+
+	var settings []isolatedSetting
+
+	for _, s := range list {
+		settings = append(settings, isolatedSetting{Key: s.key, Value: s.value, List: encodeSettings(s.list)})
+	}
+
+	return settings
+}
+
+func decodeSettings(settings []isolatedSetting) []settingValue {
+
+	var list []settingValue
+
+	for _, s := range settings {
+		list = append(list, settingValue{key: s.Key, value: s.Value, list: decodeSettings(s.List)})
+	}
+
+	return list
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.buf = append(t.buf, p...)
+
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return string(t.buf)
+}
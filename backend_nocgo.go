@@ -0,0 +1,36 @@
+//go:build !cgo || wkhtmltox_nocgo
+
+package wkhtmltox
+
+import (
+	"context"
+	"errors"
+)
+
+func defaultBackend() Backend {
+	return &CommandBackend{}
+}
+
+// Init does nothing, there's no libwkhtmltox to initialize without cgo
+func Init(options Options) error {
+	return nil
+}
+
+// Shutdown does nothing, there's no libwkhtmltox to deinitialize without cgo
+func Shutdown() {
+}
+
+// Version returns "", there's no libwkhtmltox without cgo
+func Version() string {
+	return ""
+}
+
+// ExtendedQt returns false, there's no libwkhtmltox without cgo
+func ExtendedQt() bool {
+	return false
+}
+
+// convertImage fails, wkhtmltoimage is only available through libwkhtmltox
+func convertImage(ctx context.Context, set *imageConverterSettings, html string) (*Result, error) {
+	return nil, errors.New("wkhtmltox: image conversion requires cgo and libwkhtmltox")
+}
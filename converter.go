@@ -1,14 +1,20 @@
-// wkhtmltox provides a wrapper for the C-API ./wkhtmltopdf.
+// wkhtmltox provides a wrapper for the C-APIs ./wkhtmltopdf and ./wkhtmltoimage.
 //
-// This package relies on wkhtmltopdf C library. See: https://github.com/wkhtmltopdf/wkhtmltopdf
+// This package relies on wkhtmltopdf C library, or the wkhtmltopdf binary when it's built with the wkhtmltox_nocgo tag.
+// See: https://github.com/wkhtmltopdf/wkhtmltopdf
 package wkhtmltox
 
 import (
+	"context"
 	"errors"
-	"github.com/nbosscher/wkhtmltox/wkhtmltopdf"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 )
 
 const (
@@ -25,19 +31,52 @@ const (
 type LoadErrorHandleMethod string
 type CssMediaType int
 
+var (
+	// returned when content is added to a converter, or it's converted, after Convert has been called
+	ErrAlreadyConverted = errors.New("wkhtmltox: already converted")
+
+	// returned when settings are passed that weren't created by this package's constructors
+	ErrForeignSettings = errors.New("wkhtmltox: settings must be created by this package or nil")
+)
+
 type Converter interface {
-	AddHtml(string, SectionSettings)
+	AddHtml(string, SectionSettings) error
+	AddURL(string, SectionSettings) error
+	AddFile(string, SectionSettings) error
+	AddReader(io.Reader, SectionSettings) error
+	AddTableOfContents(*TocSettings) error
 	Convert() ([]byte, error)
+	ConvertContext(context.Context) ([]byte, error)
+	ConvertResult(context.Context) (*Result, error)
+	SetProgressHandler(func(Progress))
+	SetPriority(int)
 }
 
 type pdfConverter struct {
-	converter *wkhtmltopdf.Converter
-	converted bool
+	backend         Backend
+	settings        *pdfConverterSettings
+	sections        []JobSection
+	converted       bool
+	progressHandler func(Progress)
+	priority        int
+
+	// files created for the document, removed after Convert
+	tempFiles []string
+
+	// where wkhtmltopdf dumps the outline, empty if it's not requested
+	outlinePath string
 }
 
 // NewPdfConverter accepts struct created with NewPdfConverterSettings or nil.
 // Passing nil will use the default settings.
-func NewPdfConverter(settings ConverterSettings) Converter {
+// The converter uses a copy of the settings, so they can be changed and used again afterwards.
+// The document is converted with DefaultBackend.
+func NewPdfConverter(settings ConverterSettings) (Converter, error) {
+	return NewPdfConverterWithBackend(DefaultBackend, settings)
+}
+
+// NewPdfConverterWithBackend is like NewPdfConverter, but converts the document with backend
+func NewPdfConverterWithBackend(backend Backend, settings ConverterSettings) (Converter, error) {
 
 	var set *pdfConverterSettings
 
@@ -50,83 +89,350 @@ func NewPdfConverter(settings ConverterSettings) Converter {
 
 		set, ok = settings.(*pdfConverterSettings)
 		if !ok {
-			log.Panic("settings must be of type *pdfConverterSettings or nil")
+			return nil, ErrForeignSettings
 		}
+
+		set = set.Clone().(*pdfConverterSettings)
 	}
 
-	return &pdfConverter{
-		converter: set.settings.NewConverter(),
+	p := &pdfConverter{
+		backend:  backend,
+		settings: set,
+	}
+
+	if set.DumpOutline() {
+		path, err := p.tempFile(strings.NewReader(""), ".xml")
+		if err != nil {
+			p.removeTempFiles()
+			return nil, err
+		}
+
+		p.outlinePath = path
+		set.set("dumpOutline", path)
+	}
+
+	err := set.Validate()
+	if err != nil {
+		p.removeTempFiles()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// MustNewPdfConverter is like NewPdfConverter but panics if there's an error
+func MustNewPdfConverter(settings ConverterSettings) Converter {
+
+	conv, err := NewPdfConverter(settings)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return conv
+}
+
+// Must panics if err is not nil, e.g. Must(conv.AddHtml(html, nil))
+func Must(err error) {
+	if err != nil {
+		log.Panic(err)
 	}
 }
 
 // AddHtml adds the contents of arg to the current document using the settings provided.
 // Passing settings = nil will use the default section settings
-func (p *pdfConverter) AddHtml(arg string, settings SectionSettings) {
-	if p.converted {
-		log.Panic("can't call .AddHtml after .Convert")
+func (p *pdfConverter) AddHtml(arg string, settings SectionSettings) error {
+	set, err := p.sectionSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	return p.add(set, &arg)
+}
+
+// AddURL adds the page at url to the current document using the settings provided.
+// The page is loaded by wkhtmltopdf during Convert.
+// Passing settings = nil will use the default section settings
+func (p *pdfConverter) AddURL(url string, settings SectionSettings) error {
+	set, err := p.sectionSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	set.set("page", url)
+	return p.add(set, nil)
+}
+
+// AddFile adds the html file at path to the current document using the settings provided.
+// The file is read by wkhtmltopdf during Convert.
+// Passing settings = nil will use the default section settings
+func (p *pdfConverter) AddFile(path string, settings SectionSettings) error {
+	set, err := p.sectionSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	set.set("page", path)
+	return p.add(set, nil)
+}
+
+// AddReader adds the html read from r to the current document using the settings provided.
+// The html is copied to a temporary file that is removed after Convert.
+// Passing settings = nil will use the default section settings
+func (p *pdfConverter) AddReader(r io.Reader, settings SectionSettings) error {
+	set, err := p.sectionSettings(settings)
+	if err != nil {
+		return err
+	}
+
+	path, err := p.tempFile(r, ".html")
+	if err != nil {
+		return err
+	}
+
+	set.set("page", path)
+	return p.add(set, nil)
+}
+
+// AddTableOfContents adds a table of contents section to the current document.
+// The table of contents lists the headings of all sections, including those added after it.
+// Passing toc = nil will use the default table of contents settings
+func (p *pdfConverter) AddTableOfContents(toc *TocSettings) error {
+	set, err := p.sectionSettings(nil)
+	if err != nil {
+		return err
+	}
+
+	if toc == nil {
+		toc = NewTocSettings()
+	}
+
+	set.set("isTableOfContent", "true")
+	set.set("toc.captionText", toc.CaptionText)
+	set.set("toc.useDottedLines", fmt.Sprint(toc.UseDottedLines))
+	set.set("toc.forwardLinks", fmt.Sprint(toc.ForwardLinks))
+	set.set("toc.backLinks", fmt.Sprint(toc.BackLinks))
+
+	if toc.Indentation != "" {
+		set.set("toc.indentation", toc.Indentation)
+	}
+
+	if toc.FontScale != 0 {
+		set.set("toc.fontScale", fmt.Sprintf("%.2f", toc.FontScale))
+	}
+
+	xsl := toc.XslUrl
+
+	if toc.Xsl != "" {
+		xsl, err = p.tempFile(strings.NewReader(toc.Xsl), ".xsl")
+		if err != nil {
+			return err
+		}
+	}
+
+	if xsl != "" {
+		set.set("tocXsl", xsl)
+	}
+
+	return p.add(set, nil)
+}
+
+// add adds the section to the document if its settings are valid.
+// html is the content of the section, nil if wkhtmltopdf loads it (e.g. from the page setting)
+func (p *pdfConverter) add(set *sectionSettings, html *string) error {
+
+	set.setDefaultProxy()
+
+	err := set.Validate()
+	if err != nil {
+		return err
 	}
 
-	var set *sectionSettings
+	p.sections = append(p.sections, JobSection{Settings: set, Html: html})
+
+	return nil
+}
+
+func (p *pdfConverter) sectionSettings(settings SectionSettings) (*sectionSettings, error) {
+	if p.converted {
+		return nil, ErrAlreadyConverted
+	}
 
 	if settings == nil {
+		return NewSectionSettings().(*sectionSettings), nil
+	}
 
-		set = NewSectionSettings().(*sectionSettings)
-	} else {
+	set, ok := settings.(*sectionSettings)
+	if !ok {
+		return nil, ErrForeignSettings
+	}
 
-		var ok bool
-		set, ok = settings.(*sectionSettings)
-		if !ok {
-			log.Panic("settings must be of type *sectionSettings or nil")
+	// the section is changed when it's added, e.g. with the paths of the temporary files
+	set = set.Clone().(*sectionSettings)
+
+	err := p.writeHeaderFooterHtml(set)
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// writeHeaderFooterHtml writes header/footer html given as a string to temporary files,
+// wkhtmltopdf only loads them from a url.
+func (p *pdfConverter) writeHeaderFooterHtml(set *sectionSettings) error {
+
+	if set.headerHtml != nil && *set.headerHtml != "" {
+		path, err := p.tempFile(strings.NewReader(*set.headerHtml), ".html")
+		if err != nil {
+			return err
 		}
+
+		set.set("header.htmlUrl", path)
 	}
 
-	p.converter.AddHtml(set.settings, arg)
+	if set.footerHtml != nil && *set.footerHtml != "" {
+		path, err := p.tempFile(strings.NewReader(*set.footerHtml), ".html")
+		if err != nil {
+			return err
+		}
+
+		set.set("footer.htmlUrl", path)
+	}
+
+	return nil
 }
 
-func (p *pdfConverter) Convert() ([]byte, error) {
+// tempFile copies r to a new temporary file with the extension ext and returns its path.
+// The file is removed after Convert.
+func (p *pdfConverter) tempFile(r io.Reader, ext string) (string, error) {
 
-	p.converted = true
+	f, err := ioutil.TempFile("", "wkhtmltox-*"+ext)
+	if err != nil {
+		return "", err
+	}
+
+	p.tempFiles = append(p.tempFiles, f.Name())
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (p *pdfConverter) removeTempFiles() {
+	for _, path := range p.tempFiles {
+		os.Remove(path)
+	}
+
+	p.tempFiles = nil
+}
+
+// SetProgressHandler sets a function that receives progress events while converting.
+// The handler runs on its own go-routine, one event at a time and in order.
+// Every event has been handled by the time Convert returns.
+func (p *pdfConverter) SetProgressHandler(handler func(Progress)) {
+	p.progressHandler = handler
+}
 
-	defer p.converter.Destroy()
+// SetPriority sets the priority of the conversion for backends that queue conversions, e.g. Pool.
+// Higher priorities are converted first, the default is 0.
+func (p *pdfConverter) SetPriority(priority int) {
+	p.priority = priority
+}
 
-	errs := make(chan string)
+// Convert converts the document and returns the pdf data
+func (p *pdfConverter) Convert() ([]byte, error) {
+	return p.ConvertContext(context.Background())
+}
 
-	p.converter.Warning = func(c *wkhtmltopdf.Converter, arg string) {
-		go func() {
-			errs <- "warning: " + arg
-		}()
+// ConvertContext is like Convert, but returns ctx.Err() if ctx is done before the conversion completes.
+// libwkhtmltox can't interrupt a conversion that has started, so CgoBackend abandons it instead
+// and cleans it up once the render thread is done with it. Until then it keeps the single render thread busy,
+// so a page that hangs blocks later conversions; IsolatedBackend and Pool kill the child process instead.
+func (p *pdfConverter) ConvertContext(ctx context.Context) ([]byte, error) {
+
+	result, err := p.ConvertResult(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	p.converter.Error = func(c *wkhtmltopdf.Converter, arg string) {
-		go func() {
-			errs <- "error: " + arg
-		}()
+	return result.Data, nil
+}
+
+// ConvertResult is like ConvertContext, but also returns the diagnostics reported during the conversion.
+// If the conversion fails the error is a *ConversionError.
+func (p *pdfConverter) ConvertResult(ctx context.Context) (*Result, error) {
+
+	if p.converted {
+		return nil, ErrAlreadyConverted
 	}
 
-	// must run in this control flow, can't run in separate go-routine because of C bindings
-	status := p.converter.Convert()
+	p.converted = true
 
-	errList := []string{}
-	done := false
+	// the backend reports diagnostics one at a time and in order
+	diagnostics := &diagnosticList{policy: p.settings.WarningPolicy()}
+
+	var outline []*OutlineItem
+	var outlineErr error
+	var release sync.Once
+
+	job := &Job{
+		Settings:   p.settings,
+		Sections:   p.sections,
+		Diagnostic: diagnostics.add,
+		Priority:   p.priority,
+		Release: func() {
+			release.Do(func() {
+				if p.outlinePath != "" {
+					outline, outlineErr = readOutline(p.outlinePath)
+				}
+
+				p.removeTempFiles()
+			})
+		},
+	}
 
-	for !done {
-		select {
-		case errString := <-errs:
+	if p.progressHandler != nil {
+		events := newProgressQueue(p.progressHandler)
+		defer events.close()
 
-			errList = append(errList, errString)
-		case <-time.After(1 * time.Millisecond):
+		job.Progress = events.push
+	}
 
-			done = true
+	data, err := p.backend.Convert(ctx, job)
+	if err != nil {
+		var conversionErr *ConversionError
+		if errors.As(err, &conversionErr) {
+			conversionErr.Diagnostics = diagnostics.list
 		}
+
+		return nil, err
 	}
 
-	if len(errList) != 0 {
-		return nil, errors.New("wkhtmltopdf: " + strings.Join(errList, ",\n"))
+	job.Release()
+
+	if diagnostics.failed {
+		return nil, &ConversionError{Diagnostics: diagnostics.list}
 	}
 
-	if !status {
-		return nil, errors.New("wkhtmltopdf: conversion failed")
+	if outlineErr != nil {
+		return nil, outlineErr
 	}
 
-	return p.converter.OutputAsBuffer()
+	return &Result{
+		Data:        data,
+		Diagnostics: diagnostics.list,
+		Outline:     outline,
+	}, nil
 }
@@ -2,7 +2,6 @@ package wkhtmltox
 
 import (
 	"fmt"
-	"github.com/nbosscher/wkhtmltox/wkhtmltopdf"
 	"strconv"
 )
 
@@ -56,10 +55,10 @@ type PageSize string
 type ColorMode string
 
 type MarginSetting struct {
-	Top    string // e.g. 1cm, 4in...
-	Bottom string
-	Left   string
-	Right  string
+	Top    Length `json:"top,omitempty"` // e.g. Cm(1), In(0.5)...
+	Bottom Length `json:"bottom,omitempty"`
+	Left   Length `json:"left,omitempty"`
+	Right  Length `json:"right,omitempty"`
 }
 
 // Not all wkhtmltopdf settings are implemented.
@@ -72,9 +71,9 @@ type ConverterSettings interface {
 	// sets the page size using standard sizes
 	SetPageStandardSize(PageSize)
 
-	// sets custom page dimensions using units
-	// e.g. 4in, 2cm
-	SetPageDimensions(w, h string)
+	// sets custom page dimensions
+	// e.g. In(4), Cm(2)
+	SetPageDimensions(w, h Length)
 
 	// sets the color mode (color or grayscale)
 	SetColorMode(ColorMode)
@@ -98,121 +97,373 @@ type ConverterSettings interface {
 	// Sets the jpeg compression factor to use when producing the pdf document, e.g. "92".
 	SetJpegCompression(int)
 
+	// sets the dpi used to convert the html to the pdf document, e.g. 96
+	SetDPI(int)
+
 	// Sets the path of the file used to load and store cookies.
 	SetCookieJar(string)
+
+	// sets whether or not warnings reported by wkhtmltopdf fail the conversion
+	SetWarningPolicy(WarningPolicy)
+
+	// sets whether or not to put an outline (bookmarks) into the pdf document,
+	// and the maximal depth of the outline, e.g. 4
+	SetOutline(enabled bool, depth int)
+
+	// sets whether or not to return the outline in Result.Outline
+	SetDumpOutline(bool)
+
+	// returns the first error recorded by a setter, or nil
+	Err() error
+
+	// returns every error recorded by a setter, or nil.
+	// The settings are validated before they are used.
+	Validate() error
+
+	// the getters return the effective value of a setting, i.e. wkhtmltopdf's default if it hasn't been set
+
+	Orientation() Orientation
+	PageStandardSize() PageSize
+	PageDimensions() (w, h Length)
+	ColorMode() ColorMode
+	PageOffset() int
+	DocumentTitle() string
+	UseCompression() bool
+	Margins() *MarginSetting
+	ImageDPI() int
+	DPI() int
+	JpegCompression() int
+	CookieJar() string
+	WarningPolicy() WarningPolicy
+	Outline() (enabled bool, depth int)
+	DumpOutline() bool
+
+	// returns every known setting and its effective value, e.g. to log the configuration of a document.
+	// Passwords are redacted.
+	Snapshot() map[string]string
+
+	// returns the printable area of a page, i.e. the page size without the margins
+	ContentBox() (*ContentBox, error)
+
+	// returns a copy of the settings that can be used by another converter
+	Clone() ConverterSettings
+
+	// returns a copy of the settings with the values set on overrides applied on top.
+	// The settings and overrides are not changed, so shared defaults can be layered with per-request overrides.
+	Merge(overrides ...ConverterSettings) ConverterSettings
 }
 
 type pdfConverterSettings struct {
-	settings *wkhtmltopdf.GlobalSettings
+	settingErrors
+
+	// the values applied by the setters, applied to wkhtmltopdf by the Backend
+	values settingValues
+
+	// nil if not set
+	warningPolicy *WarningPolicy
+	dumpOutline   *bool
 }
 
 func NewPdfConverterSettings() ConverterSettings {
-	return &pdfConverterSettings{
-		settings: defaultSettings(),
-	}
+	return &pdfConverterSettings{}
 }
 
-func defaultSettings() *wkhtmltopdf.GlobalSettings {
+// set applies a setting, recording the error if wkhtmltopdf doesn't know it
+func (p *pdfConverterSettings) set(name, value string) {
 
-	set := wkhtmltopdf.NewGlobalSettings()
-
-	set.Set("viewportSize", "1280x800")
-	set.Set("orientation", string(Landscape))
-	set.Set("colorMode", "Color")
-	set.Set("size.paperSize", string(PageSizeA4))
+	if !knownKey(globalSettingKeys, name) {
+		p.record(name, value, ErrRejectedSetting)
+		return
+	}
 
-	return set
+	p.values.put(name, value)
 }
 
 // sets the web page rendering size
 func (p *pdfConverterSettings) SetViewport(width, height uint32) {
 
-	p.settings.Set("viewportSize", fmt.Sprint(width)+"x"+fmt.Sprint(height))
+	p.set("viewportSize", fmt.Sprint(width)+"x"+fmt.Sprint(height))
 }
 
 // sets the page orientation
 func (p *pdfConverterSettings) SetOrientation(arg Orientation) {
 
-	p.settings.Set("orientation", string(arg))
+	p.set("orientation", string(arg))
 }
 
 // sets the page size using standard sizes
 func (p *pdfConverterSettings) SetPageStandardSize(arg PageSize) {
 
-	p.settings.Set("size.paperSize", string(arg))
+	p.set("size.paperSize", string(arg))
 }
 
-// sets custom page dimensions using units
-// e.g. 4in, 2cm
-func (p *pdfConverterSettings) SetPageDimensions(w, h string) {
+// sets custom page dimensions
+// e.g. In(4), Cm(2)
+func (p *pdfConverterSettings) SetPageDimensions(w, h Length) {
 
-	p.settings.Set("size.width", w)
-	p.settings.Set("size.height", h)
+	p.setLength("size.width", w)
+	p.setLength("size.height", h)
 }
 
 // sets the color mode (color or grayscale)
 func (p *pdfConverterSettings) SetColorMode(arg ColorMode) {
 
-	p.settings.Set("colorMode", string(arg))
+	p.set("colorMode", string(arg))
 }
 
 // sets the number that is added to all page numbers when printing headers,
 // footers and table of content.
 func (p *pdfConverterSettings) SetPageOffset(arg int) {
 
-	p.settings.Set("pageOffset", strconv.Itoa(arg))
+	p.set("pageOffset", strconv.Itoa(arg))
 }
 
 // sets the title of the PDF document.
 func (p *pdfConverterSettings) SetDocumentTitle(arg string) {
 
-	p.settings.Set("documentTitle", arg)
+	p.set("documentTitle", arg)
 }
 
 // sets whether or not to use loss less compression
 func (p *pdfConverterSettings) SetUseCompression(arg bool) {
 
 	if arg {
-		p.settings.Set("useCompression", "true")
+		p.set("useCompression", "true")
 	} else {
-		p.settings.Set("useCompression", "false")
+		p.set("useCompression", "false")
 	}
 }
 
 // sets the margins
 func (p *pdfConverterSettings) SetMargins(arg *MarginSetting) {
 
-	if arg.Top != "" {
-		p.settings.Set("margin.top", arg.Top)
-	}
+	p.setLength("margin.top", arg.Top)
+	p.setLength("margin.bottom", arg.Bottom)
+	p.setLength("margin.left", arg.Left)
+	p.setLength("margin.right", arg.Right)
+}
 
-	if arg.Bottom != "" {
-		p.settings.Set("margin.bottom", arg.Bottom)
-	}
+// setLength applies a length setting if it's set, recording the error if it's invalid
+func (p *pdfConverterSettings) setLength(name string, arg Length) {
 
-	if arg.Left != "" {
-		p.settings.Set("margin.left", arg.Left)
+	if arg.IsZero() {
+		return
 	}
 
-	if arg.Right != "" {
-		p.settings.Set("margin.right", arg.Right)
+	if reason := arg.validate(); reason != "" {
+		p.invalid(name, arg.String(), reason)
+		return
 	}
+
+	p.set(name, arg.String())
 }
 
 // Sets the maximal DPI to use for images in the pdf document.
 func (p *pdfConverterSettings) SetImageDPI(arg int) {
 
-	p.settings.Set("imageDPI", strconv.Itoa(arg))
+	if arg < 0 {
+		p.invalid("imageDPI", strconv.Itoa(arg), "must not be negative")
+		return
+	}
+
+	p.set("imageDPI", strconv.Itoa(arg))
+}
+
+// sets the dpi used to convert the html to the pdf document, e.g. 96
+func (p *pdfConverterSettings) SetDPI(arg int) {
+
+	if arg <= 0 {
+		p.invalid("dpi", strconv.Itoa(arg), "must be positive")
+		return
+	}
+
+	p.set("dpi", strconv.Itoa(arg))
 }
 
 // Sets the jpeg compression factor to use when producing the pdf document, e.g. "92".
 func (p *pdfConverterSettings) SetJpegCompression(arg int) {
 
-	p.settings.Set("imageQuality", strconv.Itoa(arg))
+	if arg < 0 || arg > 100 {
+		p.invalid("imageQuality", strconv.Itoa(arg), "must be between 0 and 100")
+		return
+	}
+
+	p.set("imageQuality", strconv.Itoa(arg))
 }
 
 // Sets the path of the file used to load and store cookies.
 func (p *pdfConverterSettings) SetCookieJar(arg string) {
 
-	p.settings.Set("load.cookieJar", arg)
+	p.set("load.cookieJar", arg)
+}
+
+// sets whether or not warnings reported by wkhtmltopdf fail the conversion
+func (p *pdfConverterSettings) SetWarningPolicy(arg WarningPolicy) {
+
+	p.warningPolicy = &arg
+}
+
+// sets whether or not to put an outline (bookmarks) into the pdf document,
+// and the maximal depth of the outline, e.g. 4
+func (p *pdfConverterSettings) SetOutline(enabled bool, depth int) {
+
+	if depth < 0 {
+		p.invalid("outlineDepth", strconv.Itoa(depth), "must not be negative")
+		return
+	}
+
+	if enabled {
+		p.set("outline", "true")
+	} else {
+		p.set("outline", "false")
+	}
+
+	p.set("outlineDepth", strconv.Itoa(depth))
+}
+
+// sets whether or not to return the outline in Result.Outline
+func (p *pdfConverterSettings) SetDumpOutline(arg bool) {
+
+	p.dumpOutline = &arg
+}
+
+// get returns the effective value of a setting, or "" if it's not set
+func (p *pdfConverterSettings) get(name string) string {
+
+	value, _ := p.lookup(name)
+	return value
+}
+
+func (p *pdfConverterSettings) lookup(name string) (string, bool) {
+	return lookup(p.values, packageGlobalSettings, globalSettingDefaults, name)
+}
+
+func (p *pdfConverterSettings) Orientation() Orientation {
+	return Orientation(p.get("orientation"))
+}
+
+func (p *pdfConverterSettings) PageStandardSize() PageSize {
+	return PageSize(p.get("size.paperSize"))
+}
+
+func (p *pdfConverterSettings) PageDimensions() (w, h Length) {
+	return parseLength(p.get("size.width")), parseLength(p.get("size.height"))
+}
+
+func (p *pdfConverterSettings) ColorMode() ColorMode {
+	return ColorMode(p.get("colorMode"))
+}
+
+func (p *pdfConverterSettings) PageOffset() int {
+	return parseInt(p.get("pageOffset"))
+}
+
+func (p *pdfConverterSettings) DocumentTitle() string {
+	return p.get("documentTitle")
+}
+
+func (p *pdfConverterSettings) UseCompression() bool {
+	return parseBool(p.get("useCompression"))
+}
+
+func (p *pdfConverterSettings) Margins() *MarginSetting {
+	return &MarginSetting{
+		Top:    parseLength(p.get("margin.top")),
+		Bottom: parseLength(p.get("margin.bottom")),
+		Left:   parseLength(p.get("margin.left")),
+		Right:  parseLength(p.get("margin.right")),
+	}
+}
+
+func (p *pdfConverterSettings) ImageDPI() int {
+	return parseInt(p.get("imageDPI"))
+}
+
+// DPI returns the dpi set with SetDPI, or 96 if it isn't set
+func (p *pdfConverterSettings) DPI() int {
+
+	dpi := parseInt(p.get("dpi"))
+	if dpi <= 0 {
+		return defaultDPI
+	}
+
+	return dpi
+}
+
+func (p *pdfConverterSettings) JpegCompression() int {
+	return parseInt(p.get("imageQuality"))
+}
+
+func (p *pdfConverterSettings) CookieJar() string {
+	return p.get("load.cookieJar")
+}
+
+func (p *pdfConverterSettings) WarningPolicy() WarningPolicy {
+	if p.warningPolicy == nil {
+		return WarningPolicyIgnore
+	}
+
+	return *p.warningPolicy
+}
+
+func (p *pdfConverterSettings) Outline() (enabled bool, depth int) {
+	return parseBool(p.get("outline")), parseInt(p.get("outlineDepth"))
+}
+
+func (p *pdfConverterSettings) DumpOutline() bool {
+	return p.dumpOutline != nil && *p.dumpOutline
+}
+
+// returns every known setting and its effective value, e.g. to log the configuration of a document
+func (p *pdfConverterSettings) Snapshot() map[string]string {
+	return snapshot(globalSettingKeys, p.lookup)
+}
+
+// Clone returns a copy of the settings, including the errors recorded by the setters.
+// Cloning settings that are not being changed is safe from multiple go-routines.
+func (p *pdfConverterSettings) Clone() ConverterSettings {
+
+	return &pdfConverterSettings{
+		settingErrors: p.settingErrors.copy(),
+		values:        p.values.copy(),
+		warningPolicy: p.warningPolicy,
+		dumpOutline:   p.dumpOutline,
+	}
+}
+
+// Merge returns a copy of the settings with every value set on overrides applied on top, in order.
+// Values overrides only have by default are not applied.
+func (p *pdfConverterSettings) Merge(overrides ...ConverterSettings) ConverterSettings {
+
+	m := &pdfConverterSettings{
+		settingErrors: p.settingErrors.copy(),
+		values:        p.values.copy(),
+		warningPolicy: p.warningPolicy,
+		dumpOutline:   p.dumpOutline,
+	}
+
+	for _, o := range overrides {
+		if o == nil {
+			continue
+		}
+
+		set, ok := o.(*pdfConverterSettings)
+		if !ok {
+			m.errs = append(m.errs, ErrForeignSettings)
+			continue
+		}
+
+		m.errs = append(m.errs, set.errs...)
+		m.values.merge(set.values)
+
+		if set.warningPolicy != nil {
+			m.warningPolicy = set.warningPolicy
+		}
+
+		if set.dumpOutline != nil {
+			m.dumpOutline = set.dumpOutline
+		}
+	}
+
+	return m
 }
@@ -0,0 +1,113 @@
+package wkhtmltox
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError   Severity = iota
+)
+
+const (
+	// warnings are returned in Result.Diagnostics, only errors fail the conversion
+	WarningPolicyIgnore WarningPolicy = iota
+
+	// any warning fails the conversion with a *ConversionError
+	WarningPolicyFatal WarningPolicy = iota
+)
+
+type Severity int
+type WarningPolicy int
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnostic is a warning or error reported by wkhtmltopdf during the conversion
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+
+	// the conversion phase the message was reported in
+	Phase            int
+	PhaseDescription string
+
+	// the url the message refers to, if one could be parsed from the message
+	URL string
+}
+
+func (d Diagnostic) String() string {
+	return d.Severity.String() + ": " + d.Message
+}
+
+var diagnosticUrlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s,()]+`)
+
+func newDiagnostic(severity Severity, message string, phase int, phaseDescription string) Diagnostic {
+	return Diagnostic{
+		Severity:         severity,
+		Message:          message,
+		Phase:            phase,
+		PhaseDescription: phaseDescription,
+		URL:              diagnosticUrlPattern.FindString(message),
+	}
+}
+
+// diagnosticList collects the diagnostics of a conversion
+type diagnosticList struct {
+	policy WarningPolicy
+	list   []Diagnostic
+
+	// whether or not the diagnostics fail the conversion
+	failed bool
+}
+
+func (d *diagnosticList) add(diagnostic Diagnostic) {
+	d.list = append(d.list, diagnostic)
+
+	if diagnostic.Severity == SeverityError || d.policy == WarningPolicyFatal {
+		d.failed = true
+	}
+}
+
+// Result holds the converted document and every diagnostic reported while converting it
+type Result struct {
+	Data        []byte
+	Diagnostics []Diagnostic
+
+	// the document outline, only set if requested with ConverterSettings.SetDumpOutline
+	Outline []*OutlineItem
+}
+
+// ConversionError is returned when wkhtmltopdf fails to convert the document.
+// Use errors.As to inspect the diagnostics that caused it.
+type ConversionError struct {
+	Diagnostics []Diagnostic
+
+	// the http error code reported by wkhtmltopdf, 0 if there was none
+	HttpErrorCode int
+}
+
+func (e *ConversionError) Error() string {
+
+	msg := "wkhtmltopdf: conversion failed"
+
+	if len(e.Diagnostics) == 0 {
+		return msg
+	}
+
+	list := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		list[i] = d.String()
+	}
+
+	return msg + ": " + strings.Join(list, ",\n")
+}
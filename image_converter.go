@@ -0,0 +1,124 @@
+package wkhtmltox
+
+import (
+	"context"
+	"log"
+)
+
+type ImageConverter interface {
+	SetHtml(string) error
+	SetURL(string) error
+	Convert() ([]byte, error)
+	ConvertContext(context.Context) ([]byte, error)
+	ConvertResult(context.Context) (*Result, error)
+}
+
+type imageConverter struct {
+	settings  *imageConverterSettings
+	html      string
+	url       string
+	converted bool
+}
+
+// NewImageConverter accepts struct created with NewImageConverterSettings or nil.
+// Passing nil will use the default settings. The converter uses a copy of the settings.
+func NewImageConverter(settings ImageConverterSettings) (ImageConverter, error) {
+
+	var set *imageConverterSettings
+
+	if settings == nil {
+
+		set = NewImageConverterSettings().(*imageConverterSettings)
+
+	} else {
+		var ok bool
+
+		set, ok = settings.(*imageConverterSettings)
+		if !ok {
+			return nil, ErrForeignSettings
+		}
+	}
+
+	return &imageConverter{
+		settings: set.clone(),
+	}, nil
+}
+
+// MustNewImageConverter is like NewImageConverter but panics if there's an error
+func MustNewImageConverter(settings ImageConverterSettings) ImageConverter {
+
+	conv, err := NewImageConverter(settings)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return conv
+}
+
+// SetHtml sets the html to render
+func (i *imageConverter) SetHtml(arg string) error {
+	if i.converted {
+		return ErrAlreadyConverted
+	}
+
+	i.html = arg
+	i.url = ""
+
+	return nil
+}
+
+// SetURL sets the url of the page to render.
+// The page is loaded by wkhtmltoimage during Convert.
+func (i *imageConverter) SetURL(url string) error {
+	if i.converted {
+		return ErrAlreadyConverted
+	}
+
+	i.html = ""
+	i.url = url
+
+	return nil
+}
+
+// Convert renders the page and returns the image data
+func (i *imageConverter) Convert() ([]byte, error) {
+	return i.ConvertContext(context.Background())
+}
+
+// ConvertContext is like Convert, but returns ctx.Err() if ctx is done before the conversion completes.
+// libwkhtmltox can't interrupt a conversion that has started, so it is abandoned instead
+// and cleaned up once the render thread is done with it. Until then it keeps the single render thread busy,
+// so a page that hangs blocks later conversions, those of CgoBackend included.
+func (i *imageConverter) ConvertContext(ctx context.Context) ([]byte, error) {
+
+	result, err := i.ConvertResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Data, nil
+}
+
+// ConvertResult is like ConvertContext, but also returns the diagnostics reported during the conversion.
+// If the conversion fails the error is a *ConversionError.
+func (i *imageConverter) ConvertResult(ctx context.Context) (*Result, error) {
+
+	if i.converted {
+		return nil, ErrAlreadyConverted
+	}
+
+	err := i.settings.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	i.converted = true
+
+	set := i.settings
+	if i.url != "" {
+		set = set.clone()
+		set.set("in", i.url)
+	}
+
+	return convertImage(ctx, set, i.html)
+}
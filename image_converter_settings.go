@@ -0,0 +1,157 @@
+package wkhtmltox
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	ImageFormatPng  ImageFormat = "png"
+	ImageFormatJpeg ImageFormat = "jpg"
+	ImageFormatBmp  ImageFormat = "bmp"
+	ImageFormatSvg  ImageFormat = "svg"
+)
+
+type ImageFormat string
+
+// CropSetting is the area of the rendered page to keep, in pixels
+type CropSetting struct {
+	Left   int
+	Top    int
+	Width  int
+	Height int
+}
+
+// Not all wkhtmltoimage settings are implemented.
+// For full list see https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pageImageGlobal
+type ImageConverterSettings interface {
+
+	// sets the image format
+	SetFormat(ImageFormat)
+
+	// sets the area of the page to render
+	SetCrop(*CropSetting)
+
+	// sets the width of the screen used to render the page in pixels, e.g. 800
+	SetScreenWidth(int)
+
+	// sets whether or not to widen the screen if the page doesn't fit in screen width
+	SetSmartWidth(bool)
+
+	// sets the compression factor to use for jpeg images, 0 - 100
+	SetQuality(int)
+
+	// sets whether or not to render the page background transparent (png and svg only)
+	SetTransparent(bool)
+
+	// sets whether or not warnings reported by wkhtmltoimage fail the conversion
+	SetWarningPolicy(WarningPolicy)
+
+	// returns the first error recorded by a setter, or nil
+	Err() error
+
+	// returns every error recorded by a setter, or nil.
+	// The settings are validated before they are used.
+	Validate() error
+}
+
+type imageConverterSettings struct {
+	settingErrors
+
+	// the values applied by the setters, applied to wkhtmltoimage when the page is rendered
+	values        settingValues
+	warningPolicy WarningPolicy
+}
+
+func NewImageConverterSettings() ImageConverterSettings {
+	return &imageConverterSettings{}
+}
+
+// clone returns a copy of the settings, so a converter doesn't share them with its caller
+func (i *imageConverterSettings) clone() *imageConverterSettings {
+
+	return &imageConverterSettings{
+		settingErrors: i.settingErrors.copy(),
+		values:        i.values.copy(),
+		warningPolicy: i.warningPolicy,
+	}
+}
+
+// set applies a setting, recording the error if wkhtmltoimage doesn't know it
+func (i *imageConverterSettings) set(name, value string) {
+
+	if !knownKey(imageSettingKeys, name) {
+		i.record(name, value, ErrRejectedSetting)
+		return
+	}
+
+	i.values.put(name, value)
+}
+
+// sets the image format
+func (i *imageConverterSettings) SetFormat(arg ImageFormat) {
+
+	i.set("fmt", string(arg))
+}
+
+// sets the area of the page to render
+func (i *imageConverterSettings) SetCrop(arg *CropSetting) {
+
+	if arg.Left < 0 || arg.Top < 0 || arg.Width < 0 || arg.Height < 0 {
+		i.invalid("crop", fmt.Sprintf("%+v", *arg), "must not be negative")
+		return
+	}
+
+	i.set("crop.left", strconv.Itoa(arg.Left))
+	i.set("crop.top", strconv.Itoa(arg.Top))
+	i.set("crop.width", strconv.Itoa(arg.Width))
+	i.set("crop.height", strconv.Itoa(arg.Height))
+}
+
+// sets the width of the screen used to render the page in pixels, e.g. 800
+func (i *imageConverterSettings) SetScreenWidth(arg int) {
+
+	if arg <= 0 {
+		i.invalid("screenWidth", strconv.Itoa(arg), "must be positive")
+		return
+	}
+
+	i.set("screenWidth", strconv.Itoa(arg))
+}
+
+// sets whether or not to widen the screen if the page doesn't fit in screen width
+func (i *imageConverterSettings) SetSmartWidth(arg bool) {
+
+	if arg {
+		i.set("smartWidth", "true")
+	} else {
+		i.set("smartWidth", "false")
+	}
+}
+
+// sets the compression factor to use for jpeg images, 0 - 100
+func (i *imageConverterSettings) SetQuality(arg int) {
+
+	if arg < 0 || arg > 100 {
+		i.invalid("quality", strconv.Itoa(arg), "must be between 0 and 100")
+		return
+	}
+
+	i.set("quality", strconv.Itoa(arg))
+}
+
+// sets whether or not to render the page background transparent (png and svg only)
+func (i *imageConverterSettings) SetTransparent(arg bool) {
+
+	if arg {
+		i.set("transparent", "true")
+	} else {
+		i.set("transparent", "false")
+	}
+}
+
+// sets whether or not warnings reported by wkhtmltoimage fail the conversion
+func (i *imageConverterSettings) SetWarningPolicy(arg WarningPolicy) {
+
+	i.warningPolicy = arg
+}
@@ -0,0 +1,144 @@
+package wkhtmltox
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+const (
+	UnitMm Unit = "mm"
+	UnitCm Unit = "cm"
+	UnitIn Unit = "in"
+	UnitPt Unit = "pt"
+
+	// wkhtmltopdf's device pixels, as many per inch as the converter's DPI (96 by default).
+	// Length.To doesn't know the DPI and converts them at 96 per inch.
+	UnitPx Unit = "px"
+)
+
+type Unit string
+
+// the length of a unit in millimeters
+var unitMm = map[Unit]float64{
+	UnitMm: 1,
+	UnitCm: 10,
+	UnitIn: 25.4,
+	UnitPt: 25.4 / 72,
+	UnitPx: 25.4 / 96,
+}
+
+// Length is a distance on the page, e.g. Cm(1.5) or ParseLength("4in").
+// The zero value means not set.
+type Length struct {
+	Value float64
+	Unit  Unit
+}
+
+func Mm(v float64) Length {
+	return Length{Value: v, Unit: UnitMm}
+}
+
+func Cm(v float64) Length {
+	return Length{Value: v, Unit: UnitCm}
+}
+
+func In(v float64) Length {
+	return Length{Value: v, Unit: UnitIn}
+}
+
+func Pt(v float64) Length {
+	return Length{Value: v, Unit: UnitPt}
+}
+
+func Px(v float64) Length {
+	return Length{Value: v, Unit: UnitPx}
+}
+
+var lengthPattern = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?|-?\.[0-9]+)(mm|cm|in|pt|px)$`)
+
+// ParseLength parses a number immediately followed by a unit, e.g. "1.5cm", "4in" or "12pt".
+// An empty string is the zero Length.
+func ParseLength(s string) (Length, error) {
+
+	if s == "" {
+		return Length{}, nil
+	}
+
+	m := lengthPattern.FindStringSubmatch(s)
+	if m == nil {
+		return Length{}, errors.New("wkhtmltox: invalid length '" + s + "', expecting a number followed by mm, cm, in, pt or px, e.g. 1.5cm")
+	}
+
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return Length{}, errors.New("wkhtmltox: invalid length '" + s + "': " + err.Error())
+	}
+
+	return Length{Value: v, Unit: Unit(m[2])}, nil
+}
+
+// IsZero returns whether or not the length is not set
+func (l Length) IsZero() bool {
+	return l == Length{}
+}
+
+// To converts the length to unit
+func (l Length) To(unit Unit) Length {
+
+	if l.Unit == unit || l.IsZero() {
+		return Length{Value: l.Value, Unit: unit}
+	}
+
+	return Length{Value: l.Value * unitMm[l.Unit] / unitMm[unit], Unit: unit}
+}
+
+// mm returns the length in mm, converting px at dpi the way wkhtmltopdf does
+func (l Length) mm(dpi int) float64 {
+
+	if l.Unit == UnitPx {
+		return l.Value * 25.4 / float64(dpi)
+	}
+
+	return l.To(UnitMm).Value
+}
+
+// String formats the length the way wkhtmltopdf reads it, e.g. "1.5cm". The zero Length is "".
+func (l Length) String() string {
+
+	if l.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatFloat(l.Value, 'f', -1, 64) + string(l.Unit)
+}
+
+// validate returns why the length can't be used as a setting, or ""
+func (l Length) validate() string {
+
+	if _, ok := unitMm[l.Unit]; !ok {
+		return "unknown unit '" + string(l.Unit) + "', expecting mm, cm, in, pt or px"
+	}
+
+	if l.Value < 0 {
+		return "must not be negative"
+	}
+
+	return ""
+}
+
+func (l Length) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Length) UnmarshalText(text []byte) error {
+
+	v, err := ParseLength(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = v
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package wkhtmltox
+
+import (
+	"errors"
+)
+
+// Options configures libwkhtmltox, see Init
+type Options struct {
+
+	// let Qt use the graphics system, e.g. an X server, which some features need. Default false
+	UseGraphics bool
+}
+
+var (
+	// returned by Init if libwkhtmltox is already initialized, e.g. lazily by an earlier conversion
+	ErrInitialized = errors.New("wkhtmltox: libwkhtmltox is already initialized")
+
+	// returned by conversions that need libwkhtmltox after Shutdown, it can't be initialized again
+	ErrShutdown = errors.New("wkhtmltox: libwkhtmltox is shut down")
+)
@@ -0,0 +1,315 @@
+package wkhtmltox
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the network settings of a section, see https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pageLoad
+//
+// wkhtmltopdf's list settings are set element by element:
+//
+//	load.customHeaders.clear
+//	load.customHeaders.append
+//	load.customHeaders[0].first = X-Name
+//	load.customHeaders[0].second = value
+//
+// so names and values are passed to wkhtmltopdf as they are, and don't need to be escaped for a list syntax.
+// What can't be passed as a C string, or would change the meaning of the request, is rejected by the setters.
+
+// sets the credentials for http basic authentication
+func (s *sectionSettings) SetBasicAuth(username, password string) {
+
+	if strings.ContainsRune(username, 0) || strings.ContainsRune(username, ':') {
+		s.invalid("load.username", username, "must not contain ':' or NUL")
+		return
+	}
+
+	if strings.ContainsRune(password, 0) {
+		s.invalid("load.password", "***", "must not contain NUL")
+		return
+	}
+
+	s.set("load.username", username)
+	s.set("load.password", password)
+}
+
+// sets the headers sent when requesting the page
+func (s *sectionSettings) SetCustomHeaders(arg http.Header) {
+
+	items := [][]string{}
+
+	for _, name := range sortedKeys(arg) {
+		if !validToken(name) {
+			s.invalid("load.customHeaders", name, "invalid header name")
+			return
+		}
+
+		for _, value := range arg[name] {
+			if strings.ContainsAny(value, "\r\n\x00") {
+				s.invalid("load.customHeaders", name+": "+value, "header values must not contain CR, LF or NUL")
+				return
+			}
+
+			items = append(items, []string{"first", name, "second", value})
+		}
+	}
+
+	s.setList("load.customHeaders", items)
+}
+
+// sets whether or not to send the custom headers with every request the page makes, not only the request for the page
+func (s *sectionSettings) SetRepeatCustomHeaders(arg bool) {
+
+	if arg {
+		s.set("load.repeatCustomHeaders", "true")
+	} else {
+		s.set("load.repeatCustomHeaders", "false")
+	}
+}
+
+// sets the form values posted when requesting the page
+func (s *sectionSettings) SetPostValues(arg url.Values) {
+
+	items := [][]string{}
+
+	for _, name := range sortedKeys(arg) {
+		for _, value := range arg[name] {
+			if strings.ContainsRune(name, 0) || strings.ContainsRune(value, 0) {
+				s.invalid("load.post", name, "must not contain NUL")
+				return
+			}
+
+			items = append(items, []string{"name", name, "value", value, "file", "false"})
+		}
+	}
+
+	s.setList("load.post", items)
+}
+
+// sets the cookies sent when requesting the page.
+// Only the name and value of a cookie are used, characters a cookie value can't contain are percent-encoded.
+func (s *sectionSettings) SetCookies(arg []*http.Cookie) {
+
+	items := [][]string{}
+
+	for _, c := range arg {
+		if !validToken(c.Name) {
+			s.invalid("load.cookies", c.Name, "invalid cookie name")
+			return
+		}
+
+		items = append(items, []string{"first", c.Name, "second", escapeCookieValue(c.Value)})
+	}
+
+	s.setList("load.cookies", items)
+}
+
+// sets the value of window.status to wait for before rendering, e.g. "ready".
+// The page sets it when it's done, e.g. after its charts are drawn: window.status = "ready"
+func (s *sectionSettings) SetWindowStatus(arg string) {
+
+	if strings.ContainsRune(arg, 0) {
+		s.invalid("load.windowStatus", arg, "must not contain NUL")
+		return
+	}
+
+	s.set("load.windowStatus", arg)
+}
+
+// adds javascript to run after the page is loaded, scripts run in the order they're added
+func (s *sectionSettings) AddRunScript(js string) {
+
+	if strings.ContainsRune(js, 0) {
+		s.invalid("load.runScript", js, "must not contain NUL")
+		return
+	}
+
+	items := [][]string{}
+
+	for _, item := range s.getList("load.runScript", "") {
+		items = append(items, []string{"", item[0]})
+	}
+
+	s.setList("load.runScript", append(items, []string{"", js}))
+}
+
+// sets whether or not to stop scripts that run too long
+func (s *sectionSettings) SetStopSlowScripts(arg bool) {
+
+	if arg {
+		s.set("load.stopSlowScript", "true")
+	} else {
+		s.set("load.stopSlowScript", "false")
+	}
+}
+
+// setList replaces the list setting name with items.
+// Every item is a list of field names and values, e.g. {"first", "X-Name", "second", "value"},
+// or {"", "value"} for a list of strings.
+func (s *sectionSettings) setList(name string, items [][]string) {
+
+	list := []settingValue{{key: name + ".clear"}}
+
+	for i, item := range items {
+		list = append(list, settingValue{key: name + ".append"})
+
+		for f := 0; f+1 < len(item); f += 2 {
+			list = append(list, settingValue{
+				key:   listKey(name, i, item[f]),
+				value: item[f+1],
+			})
+		}
+	}
+
+	s.values.putList(name, list)
+}
+
+// getList returns the fields of every item of the list setting name
+func (s *sectionSettings) getList(name string, fields ...string) [][]string {
+
+	list := s.values.getList(name)
+	values := map[string]string{}
+	n := 0
+
+	for _, v := range list {
+		if v.key == name+".append" {
+			n++
+		}
+
+		values[v.key] = v.value
+	}
+
+	items := make([][]string, n)
+
+	for i := range items {
+		for _, f := range fields {
+			items[i] = append(items[i], values[listKey(name, i, f)])
+		}
+	}
+
+	return items
+}
+
+// listKey returns the key of field of the item at i of the list setting name, e.g. load.cookies[0].first
+func listKey(name string, i int, field string) string {
+
+	key := name + "[" + strconv.Itoa(i) + "]"
+
+	if field != "" {
+		key += "." + field
+	}
+
+	return key
+}
+
+func (s *sectionSettings) BasicAuth() (username, password string) {
+	return s.get("load.username"), s.get("load.password")
+}
+
+func (s *sectionSettings) CustomHeaders() http.Header {
+
+	h := http.Header{}
+
+	for _, item := range s.getList("load.customHeaders", "first", "second") {
+		h[item[0]] = append(h[item[0]], item[1])
+	}
+
+	return h
+}
+
+func (s *sectionSettings) RepeatCustomHeaders() bool {
+	return parseBool(s.get("load.repeatCustomHeaders"))
+}
+
+func (s *sectionSettings) PostValues() url.Values {
+
+	v := url.Values{}
+
+	for _, item := range s.getList("load.post", "name", "value") {
+		v.Add(item[0], item[1])
+	}
+
+	return v
+}
+
+func (s *sectionSettings) Cookies() []*http.Cookie {
+
+	cookies := []*http.Cookie{}
+
+	for _, item := range s.getList("load.cookies", "first", "second") {
+		cookies = append(cookies, &http.Cookie{Name: item[0], Value: item[1]})
+	}
+
+	return cookies
+}
+
+func sortedKeys(m map[string][]string) []string {
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// validToken returns whether or not s is a valid header or cookie name (RFC 7230 token)
+func validToken(s string) bool {
+
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// escapeCookieValue percent-encodes the bytes that aren't allowed in a cookie value (RFC 6265 cookie-octet)
+func escapeCookieValue(v string) string {
+
+	b := strings.Builder{}
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+
+		if c == 0x21 || (c >= 0x23 && c <= 0x2b) || (c >= 0x2d && c <= 0x3a) || (c >= 0x3c && c <= 0x5b) || (c >= 0x5d && c <= 0x7e) {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+func (s *sectionSettings) WindowStatus() string {
+	return s.get("load.windowStatus")
+}
+
+func (s *sectionSettings) RunScripts() []string {
+
+	scripts := []string{}
+
+	for _, item := range s.getList("load.runScript", "") {
+		scripts = append(scripts, item[0])
+	}
+
+	return scripts
+}
+
+func (s *sectionSettings) StopSlowScripts() bool {
+	return parseBool(s.get("load.stopSlowScript"))
+}
@@ -0,0 +1,88 @@
+package wkhtmltox
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+)
+
+// OutlineItem is a heading in the document outline
+type OutlineItem struct {
+	Title string
+
+	// the page the heading is on
+	Page int
+
+	// the depth of the heading, top level headings are 1
+	Level int
+
+	Children []*OutlineItem
+}
+
+// outlineXmlItem is an item of the xml written by wkhtmltopdf's dumpOutline, e.g.
+//
+//	<outline xmlns="http://wkhtmltopdf.org/outline">
+//	  <item title="" page="0" link="" backLink="">
+//	    <item title="Hello world" page="1" link="__WKANCHOR_0" backLink="__WKANCHOR_1"/>
+//	  </item>
+//	</outline>
+//
+// The top level items are the untitled roots of each section.
+type outlineXmlItem struct {
+	Title string           `xml:"title,attr"`
+	Page  int              `xml:"page,attr"`
+	Items []outlineXmlItem `xml:"item"`
+}
+
+type outlineXml struct {
+	Items []outlineXmlItem `xml:"item"`
+}
+
+func readOutline(path string) ([]*OutlineItem, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseOutline(data)
+}
+
+func parseOutline(data []byte) ([]*OutlineItem, error) {
+
+	// wkhtmltopdf leaves the file empty e.g. for documents without headings
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []*OutlineItem{}, nil
+	}
+
+	doc := outlineXml{}
+
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*OutlineItem{}
+
+	for _, root := range doc.Items {
+		items = append(items, newOutlineItems(root.Items, 1)...)
+	}
+
+	return items, nil
+}
+
+func newOutlineItems(list []outlineXmlItem, level int) []*OutlineItem {
+
+	items := make([]*OutlineItem, len(list))
+
+	for i, item := range list {
+		items[i] = &OutlineItem{
+			Title:    item.Title,
+			Page:     item.Page,
+			Level:    level,
+			Children: newOutlineItems(item.Items, level+1),
+		}
+	}
+
+	return items
+}
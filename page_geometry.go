@@ -0,0 +1,118 @@
+package wkhtmltox
+
+import (
+	"errors"
+)
+
+// the css resolution, used when no dpi is set
+const defaultDPI = 96
+
+// the portrait width and height of the standard page sizes in mm,
+// see http://doc.qt.io/qt-4.8/qprinter.html#PaperSize-enum
+var pageSizeDimensions = map[PageSize][2]float64{
+	PageSizeA0:        {841, 1189},
+	PageSizeA1:        {594, 841},
+	PageSizeA2:        {420, 594},
+	PageSizeA3:        {297, 420},
+	PageSizeA4:        {210, 297},
+	PageSizeA5:        {148, 210},
+	PageSizeA6:        {105, 148},
+	PageSizeA7:        {74, 105},
+	PageSizeA8:        {52, 74},
+	PageSizeA9:        {37, 52},
+	PageSizeB0:        {1000, 1414},
+	PageSizeB1:        {707, 1000},
+	PageSizeB2:        {500, 707},
+	PageSizeB3:        {353, 500},
+	PageSizeB4:        {250, 353},
+	PageSizeB5:        {176, 250},
+	PageSizeB6:        {125, 176},
+	PageSizeB7:        {88, 125},
+	PageSizeB8:        {62, 88},
+	PageSizeB9:        {33, 62},
+	PageSizeB10:       {31, 44},
+	PageSizeC5E:       {163, 229},
+	PageSizeComm10E:   {105, 241},
+	PageSizeDLE:       {110, 220},
+	PageSizeExecutive: {190.5, 254},
+	PageSizeFolio:     {210, 330},
+	PageSizeLedger:    {431.8, 279.4},
+	PageSizeLegal:     {215.9, 355.6},
+	PageSizeLetter:    {215.9, 279.4},
+	PageSizeTabloid:   {279.4, 431.8},
+}
+
+// Dimensions returns the width and height of the page size in mm, in portrait orientation.
+// ok is false if the page size isn't known.
+func (s PageSize) Dimensions() (w, h Length, ok bool) {
+
+	d, ok := pageSizeDimensions[s]
+	if !ok {
+		return Length{}, Length{}, false
+	}
+
+	return Mm(d[0]), Mm(d[1]), true
+}
+
+// ContentBox is the printable area of a page, i.e. the page without its margins
+type ContentBox struct {
+	// in mm
+	Width  Length
+	Height Length
+
+	// in css pixels at DPI, the size to design content for that fills the page
+	WidthPx  float64
+	HeightPx float64
+
+	DPI int
+}
+
+// ContentBox calculates the printable area of a page from the page size, orientation and margins.
+// Custom dimensions take precedence over the standard size, margins that aren't set count as wkhtmltopdf's 10mm.
+// Lengths in px are converted at DPI, like wkhtmltopdf does.
+// Zoom and intelligent shrinking of the sections aren't taken into account.
+func (p *pdfConverterSettings) ContentBox() (*ContentBox, error) {
+
+	w, h := p.PageDimensions()
+
+	if w.IsZero() || h.IsZero() {
+		var ok bool
+
+		w, h, ok = p.PageStandardSize().Dimensions()
+		if !ok {
+			return nil, errors.New("wkhtmltox: unknown page size '" + string(p.PageStandardSize()) + "'")
+		}
+	}
+
+	if p.Orientation() == Landscape {
+		w, h = h, w
+	}
+
+	m := p.Margins()
+	dpi := p.DPI()
+
+	width := w.mm(dpi) - margin(m.Left, dpi) - margin(m.Right, dpi)
+	height := h.mm(dpi) - margin(m.Top, dpi) - margin(m.Bottom, dpi)
+
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("wkhtmltox: the margins don't leave space for content")
+	}
+
+	return &ContentBox{
+		Width:    Mm(width),
+		Height:   Mm(height),
+		WidthPx:  width / 25.4 * float64(dpi),
+		HeightPx: height / 25.4 * float64(dpi),
+		DPI:      dpi,
+	}, nil
+}
+
+// margin returns the margin in mm, 0 if it isn't valid
+func margin(l Length, dpi int) float64 {
+
+	if l.IsZero() || l.Value < 0 {
+		return 0
+	}
+
+	return l.mm(dpi)
+}
@@ -0,0 +1,327 @@
+package wkhtmltox
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// returned by Pool.Convert once the pool is closed
+var ErrPoolClosed = errors.New("wkhtmltox: pool is closed")
+
+// PoolOptions configures a Pool, the zero value of a field is its default
+type PoolOptions struct {
+
+	// the number of workers, i.e. child processes converting in parallel. Defaults to runtime.NumCPU()
+	Workers int
+
+	// the number of jobs that wait for a worker, Convert blocks while the queue is full. Defaults to 10 * Workers
+	QueueSize int
+
+	// the number of jobs after which a worker's child process is replaced, no limit if 0
+	MaxJobsPerWorker int
+
+	// the resident set size in bytes after which a worker's child process is replaced, no limit if 0.
+	// It's only known on linux.
+	MaxWorkerRSS int64
+
+	// how long a conversion may take before the child process is killed, no limit if 0
+	Timeout time.Duration
+
+	// the path of the binary the workers run, the current executable if it's empty, see IsolatedBackend
+	Path string
+}
+
+// PoolStats is a snapshot of the state of a Pool
+type PoolStats struct {
+	Workers int
+
+	// the workers converting a job
+	Active int
+
+	// the jobs waiting for a worker
+	Queued int
+
+	// the jobs converted, successfully or not, and those that failed
+	Completed int
+	Failed    int
+
+	// the child processes replaced because of MaxJobsPerWorker or MaxWorkerRSS
+	Recycled int
+
+	// the average time from Convert to its result, including the time in the queue
+	AverageLatency time.Duration
+}
+
+// Pool is a Backend that converts documents in parallel, in child processes like IsolatedBackend.
+// Jobs wait in a bounded queue for a worker, higher Job.Priority first and in order of arrival otherwise.
+// Pool is safe to use from multiple go-routines.
+type Pool struct {
+	options PoolOptions
+
+	// a slot is taken for every queued job, so Convert blocks while the queue is full
+	slots chan struct{}
+
+	mu     sync.Mutex
+	ready  *sync.Cond
+	queue  poolQueue
+	seq    uint64
+	closed bool
+	stats  PoolStats
+
+	// the sum of the latency of the completed jobs
+	latency time.Duration
+
+	workers sync.WaitGroup
+}
+
+type poolRequest struct {
+	ctx      context.Context
+	job      *Job
+	priority int
+	seq      uint64
+	queued   time.Time
+	reply    chan poolReply
+
+	// the position in the queue, -1 once a worker took it
+	index int
+}
+
+type poolReply struct {
+	data []byte
+	err  error
+}
+
+// NewPool starts the workers of a pool, their child processes are started by their first job
+func NewPool(options PoolOptions) (*Pool, error) {
+
+	if options.Workers < 0 || options.QueueSize < 0 || options.MaxJobsPerWorker < 0 || options.MaxWorkerRSS < 0 || options.Timeout < 0 {
+		return nil, errors.New("wkhtmltox: pool options must not be negative")
+	}
+
+	if options.Workers == 0 {
+		options.Workers = runtime.NumCPU()
+	}
+
+	if options.QueueSize == 0 {
+		options.QueueSize = 10 * options.Workers
+	}
+
+	p := &Pool{
+		options: options,
+		slots:   make(chan struct{}, options.QueueSize),
+		stats:   PoolStats{Workers: options.Workers},
+	}
+
+	p.ready = sync.NewCond(&p.mu)
+
+	for i := 0; i < options.Workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+
+	return p, nil
+}
+
+// Convert queues job and waits for a worker to convert it.
+// It blocks while the queue is full, and returns ctx.Err() if ctx is done first.
+// If ctx is done while the job is converted the worker's child process is killed.
+func (p *Pool) Convert(ctx context.Context, job *Job) ([]byte, error) {
+
+	defer job.Release()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+
+		return nil, ErrPoolClosed
+	}
+
+	p.seq++
+
+	req := &poolRequest{
+		ctx:      ctx,
+		job:      job,
+		priority: job.Priority,
+		seq:      p.seq,
+		queued:   time.Now(),
+		reply:    make(chan poolReply, 1),
+	}
+
+	heap.Push(&p.queue, req)
+	p.ready.Signal()
+	p.mu.Unlock()
+
+	select {
+	case r := <-req.reply:
+		return r.data, r.err
+
+	case <-ctx.Done():
+		p.mu.Lock()
+
+		if req.index >= 0 {
+			heap.Remove(&p.queue, req.index)
+			p.mu.Unlock()
+			<-p.slots
+
+			return nil, ctx.Err()
+		}
+
+		p.mu.Unlock()
+
+		// a worker took it, and kills the child process
+		r := <-req.reply
+		return r.data, r.err
+	}
+}
+
+// Stats returns a snapshot of the state of the pool
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Queued = len(p.queue)
+
+	if stats.Completed > 0 {
+		stats.AverageLatency = p.latency / time.Duration(stats.Completed)
+	}
+
+	return stats
+}
+
+// Close stops the pool: queued jobs fail with ErrPoolClosed, jobs being converted are finished,
+// then the child processes are stopped. Close waits for all of it.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+
+	p.closed = true
+
+	for len(p.queue) > 0 {
+		req := heap.Pop(&p.queue).(*poolRequest)
+		req.reply <- poolReply{err: ErrPoolClosed}
+		<-p.slots
+	}
+
+	p.ready.Broadcast()
+	p.mu.Unlock()
+
+	p.workers.Wait()
+
+	return nil
+}
+
+func (p *Pool) work() {
+	defer p.workers.Done()
+
+	w := &isolatedWorker{path: p.options.Path}
+	defer w.stop()
+
+	for {
+		req := p.next()
+		if req == nil {
+			return
+		}
+
+		data, err := w.convert(req.ctx, req.job, p.options.Timeout)
+
+		recycle := w.running() && ((p.options.MaxJobsPerWorker > 0 && w.jobs >= p.options.MaxJobsPerWorker) ||
+			(p.options.MaxWorkerRSS > 0 && w.rss() >= p.options.MaxWorkerRSS))
+
+		if recycle {
+			w.stop()
+		}
+
+		p.mu.Lock()
+		p.stats.Active--
+		p.stats.Completed++
+		p.latency += time.Since(req.queued)
+
+		if err != nil {
+			p.stats.Failed++
+		}
+
+		if recycle {
+			p.stats.Recycled++
+		}
+
+		p.mu.Unlock()
+
+		req.reply <- poolReply{data: data, err: err}
+	}
+}
+
+// next waits for the next job, it returns nil once the pool is closed
+func (p *Pool) next() *poolRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.queue) == 0 && !p.closed {
+		p.ready.Wait()
+	}
+
+	if len(p.queue) == 0 {
+		return nil
+	}
+
+	req := heap.Pop(&p.queue).(*poolRequest)
+	<-p.slots
+	p.stats.Active++
+
+	return req
+}
+
+// poolQueue orders the requests by priority, then by arrival, see container/heap
+type poolQueue []*poolRequest
+
+func (q poolQueue) Len() int {
+	return len(q)
+}
+
+func (q poolQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q poolQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *poolQueue) Push(x interface{}) {
+	req := x.(*poolRequest)
+	req.index = len(*q)
+	*q = append(*q, req)
+}
+
+func (q *poolQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+
+	req := old[n-1]
+	old[n-1] = nil
+	req.index = -1
+	*q = old[:n-1]
+
+	return req
+}
@@ -0,0 +1,602 @@
+package wkhtmltox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ConverterProfile is the serialized form of ConverterSettings.
+// Omitted fields keep their current (default) value.
+//
+//	{
+//	  "orientation": "Portrait",
+//	  "pageSize": "Letter",
+//	  "colorMode": "Grayscale",
+//	  "margins": {"top": "1cm", "bottom": "1cm", "left": "2cm", "right": "2cm"},
+//	  "warningPolicy": "ignore"
+//	}
+type ConverterProfile struct {
+	Orientation     Orientation    `json:"orientation,omitempty"`
+	PageSize        PageSize       `json:"pageSize,omitempty"`
+	PageWidth       *Length        `json:"pageWidth,omitempty"`  // e.g. 4in
+	PageHeight      *Length        `json:"pageHeight,omitempty"` // e.g. 2cm
+	ColorMode       ColorMode      `json:"colorMode,omitempty"`
+	PageOffset      *int           `json:"pageOffset,omitempty"`
+	DocumentTitle   string         `json:"documentTitle,omitempty"`
+	UseCompression  *bool          `json:"useCompression,omitempty"`
+	Margins         *MarginSetting `json:"margins,omitempty"`
+	ImageDPI        *int           `json:"imageDPI,omitempty"`
+	JpegCompression *int           `json:"jpegCompression,omitempty"` // 0 - 100
+	CookieJar       string         `json:"cookieJar,omitempty"`
+	WarningPolicy   *WarningPolicy `json:"warningPolicy,omitempty"` // "ignore" or "fatal"
+	Outline         *bool          `json:"outline,omitempty"`
+	OutlineDepth    *int           `json:"outlineDepth,omitempty"`
+	DumpOutline     *bool          `json:"dumpOutline,omitempty"`
+	DPI             *int           `json:"dpi,omitempty"`
+	Viewport        string         `json:"viewport,omitempty"` // WIDTHxHEIGHT, e.g. 1280x800
+}
+
+// SectionProfile is the serialized form of SectionSettings.
+// Omitted fields keep their current (default) value.
+//
+//	{
+//	  "enableImages": false,
+//	  "javascriptDelay": "200ms",
+//	  "cssMediaType": "print",
+//	  "footer": {"right": "[page] / [topage]", "fontSize": 8}
+//	}
+type SectionProfile struct {
+	EnableJavascript           *bool                 `json:"enableJavascript,omitempty"`
+	JavascriptDelay            string                `json:"javascriptDelay,omitempty"` // a duration, e.g. "200ms"
+	DebugJavascript            *bool                 `json:"debugJavascript,omitempty"`
+	EnableImages               *bool                 `json:"enableImages,omitempty"`
+	EnableIntelligentShrinking *bool                 `json:"enableIntelligentShrinking,omitempty"`
+	CssMediaType               *CssMediaType         `json:"cssMediaType,omitempty"` // "print" or "screen"
+	DefaultEncoding            string                `json:"defaultEncoding,omitempty"`
+	LoadReferencedLocalFiles   *bool                 `json:"loadReferencedLocalFiles,omitempty"`
+	LoadErrorHandling          LoadErrorHandleMethod `json:"loadErrorHandling,omitempty"` // "abort", "skip" or "ignore"
+	ConvertExternalLinks       *bool                 `json:"convertExternalLinks,omitempty"`
+	ConvertInternalLinks       *bool                 `json:"convertInternalLinks,omitempty"`
+	ConvertForms               *bool                 `json:"convertForms,omitempty"`
+	ZoomFactor                 *float32              `json:"zoomFactor,omitempty"`
+	Header                     *HeaderFooter         `json:"header,omitempty"`
+	Footer                     *HeaderFooter         `json:"footer,omitempty"`
+	IncludeInOutline           *bool                 `json:"includeInOutline,omitempty"`
+	WindowStatus               string                `json:"windowStatus,omitempty"`
+	RunScripts                 []string              `json:"runScripts,omitempty"`
+	StopSlowScripts            *bool                 `json:"stopSlowScripts,omitempty"`
+	Username                   string                `json:"username,omitempty"`
+	Password                   string                `json:"password,omitempty"`
+	CustomHeaders              map[string][]string   `json:"customHeaders,omitempty"`
+	RepeatCustomHeaders        *bool                 `json:"repeatCustomHeaders,omitempty"`
+	PostValues                 map[string][]string   `json:"postValues,omitempty"`
+	Cookies                    []CookieProfile       `json:"cookies,omitempty"`
+	Proxy                      *string               `json:"proxy,omitempty"` // e.g. http://proxy:3128, "" for no proxy
+}
+
+// CookieProfile is the serialized form of a cookie set with SectionSettings.SetCookies
+type CookieProfile struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Profile holds the settings loaded with LoadProfile
+type Profile struct {
+	Converter ConverterSettings
+	Section   SectionSettings
+}
+
+// profileFile is the shape of a profile file
+//
+//	{
+//	  "converter": { ConverterProfile },
+//	  "section": { SectionProfile }
+//	}
+type profileFile struct {
+	Converter *ConverterProfile `json:"converter,omitempty"`
+	Section   *SectionProfile   `json:"section,omitempty"`
+}
+
+// LoadProfile reads converter and section settings from a json file.
+// Unknown keys and invalid values are an error.
+func LoadProfile(path string) (*Profile, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := profileFile{}
+
+	err = decodeStrict(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("wkhtmltox: profile %s: %w", path, err)
+	}
+
+	converter := NewPdfConverterSettings().(*pdfConverterSettings)
+	section := NewSectionSettings().(*sectionSettings)
+
+	if file.Converter != nil {
+		converter.apply(file.Converter)
+	}
+
+	if file.Section != nil {
+		section.apply(file.Section)
+	}
+
+	err = errors.Join(converter.Validate(), section.Validate())
+	if err != nil {
+		return nil, fmt.Errorf("wkhtmltox: profile %s: %w", path, err)
+	}
+
+	return &Profile{
+		Converter: converter,
+		Section:   section,
+	}, nil
+}
+
+// decodeStrict decodes json, rejecting unknown keys
+func decodeStrict(data []byte, v interface{}) error {
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+// Profile returns the effective settings as a profile
+func (p *pdfConverterSettings) Profile() *ConverterProfile {
+
+	w, h := p.PageDimensions()
+	pageOffset := p.PageOffset()
+	useCompression := p.UseCompression()
+	imageDPI := p.ImageDPI()
+	jpegCompression := p.JpegCompression()
+	warningPolicy := p.WarningPolicy()
+	outline, outlineDepth := p.Outline()
+	dumpOutline := p.DumpOutline()
+	dpi := p.DPI()
+
+	return &ConverterProfile{
+		Orientation:     p.Orientation(),
+		PageSize:        p.PageStandardSize(),
+		PageWidth:       lengthOrNil(w),
+		PageHeight:      lengthOrNil(h),
+		ColorMode:       p.ColorMode(),
+		PageOffset:      &pageOffset,
+		DocumentTitle:   p.DocumentTitle(),
+		UseCompression:  &useCompression,
+		Margins:         p.Margins(),
+		ImageDPI:        &imageDPI,
+		JpegCompression: &jpegCompression,
+		CookieJar:       p.CookieJar(),
+		WarningPolicy:   &warningPolicy,
+		Outline:         &outline,
+		OutlineDepth:    &outlineDepth,
+		DumpOutline:     &dumpOutline,
+		DPI:             &dpi,
+		Viewport:        p.get("viewportSize"),
+	}
+}
+
+// apply sets every field of the profile that isn't omitted
+func (p *pdfConverterSettings) apply(profile *ConverterProfile) {
+
+	if profile.Orientation != "" {
+		p.SetOrientation(profile.Orientation)
+	}
+
+	if profile.PageSize != "" {
+		p.SetPageStandardSize(profile.PageSize)
+	}
+
+	if profile.PageWidth != nil || profile.PageHeight != nil {
+		w, h := Length{}, Length{}
+
+		if profile.PageWidth != nil {
+			w = *profile.PageWidth
+		}
+
+		if profile.PageHeight != nil {
+			h = *profile.PageHeight
+		}
+
+		p.SetPageDimensions(w, h)
+	}
+
+	if profile.ColorMode != "" {
+		p.SetColorMode(profile.ColorMode)
+	}
+
+	if profile.PageOffset != nil {
+		p.SetPageOffset(*profile.PageOffset)
+	}
+
+	if profile.DocumentTitle != "" {
+		p.SetDocumentTitle(profile.DocumentTitle)
+	}
+
+	if profile.UseCompression != nil {
+		p.SetUseCompression(*profile.UseCompression)
+	}
+
+	if profile.Margins != nil {
+		p.SetMargins(profile.Margins)
+	}
+
+	if profile.ImageDPI != nil {
+		p.SetImageDPI(*profile.ImageDPI)
+	}
+
+	if profile.JpegCompression != nil {
+		p.SetJpegCompression(*profile.JpegCompression)
+	}
+
+	if profile.CookieJar != "" {
+		p.SetCookieJar(profile.CookieJar)
+	}
+
+	if profile.WarningPolicy != nil {
+		p.SetWarningPolicy(*profile.WarningPolicy)
+	}
+
+	if profile.Outline != nil || profile.OutlineDepth != nil {
+		enabled, depth := p.Outline()
+
+		if profile.Outline != nil {
+			enabled = *profile.Outline
+		}
+
+		if profile.OutlineDepth != nil {
+			depth = *profile.OutlineDepth
+		}
+
+		p.SetOutline(enabled, depth)
+	}
+
+	if profile.DumpOutline != nil {
+		p.SetDumpOutline(*profile.DumpOutline)
+	}
+
+	if profile.DPI != nil {
+		p.SetDPI(*profile.DPI)
+	}
+
+	if profile.Viewport != "" {
+		var width, height uint32
+
+		_, err := fmt.Sscanf(profile.Viewport, "%dx%d", &width, &height)
+		if err != nil {
+			p.invalid("viewportSize", profile.Viewport, "expecting WIDTHxHEIGHT, e.g. 1280x800")
+		} else {
+			p.SetViewport(width, height)
+		}
+	}
+}
+
+func lengthOrNil(l Length) *Length {
+	if l.IsZero() {
+		return nil
+	}
+
+	return &l
+}
+
+func (p *pdfConverterSettings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Profile())
+}
+
+// UnmarshalJSON applies a ConverterProfile, unknown keys are an error
+func (p *pdfConverterSettings) UnmarshalJSON(data []byte) error {
+
+	profile := ConverterProfile{}
+
+	err := decodeStrict(data, &profile)
+	if err != nil {
+		return err
+	}
+
+	p.apply(&profile)
+
+	return nil
+}
+
+// the custom headers that hold credentials, Profile leaves them out
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// Profile returns the effective settings as a profile.
+// Profiles are meant to be written to disk and shared, so it leaves out the secrets:
+// the password, the credential headers, the cookies and the password of the proxy.
+// MarshalSectionWithSecrets includes them.
+func (s *sectionSettings) Profile() *SectionProfile {
+	return s.profile(false)
+}
+
+// MarshalSectionWithSecrets is like json.Marshal of section settings,
+// but includes the secrets Profile leaves out
+func MarshalSectionWithSecrets(settings SectionSettings) ([]byte, error) {
+
+	s, ok := settings.(*sectionSettings)
+	if !ok {
+		return nil, ErrForeignSettings
+	}
+
+	return json.Marshal(s.profile(true))
+}
+
+func (s *sectionSettings) profile(secrets bool) *SectionProfile {
+
+	enableJavascript := s.EnableJavascript()
+	debugJavascript := s.DebugJavascript()
+	enableImages := s.EnableImages()
+	enableIntelligentShrinking := s.EnableIntelligentShrinking()
+	cssMediaType := s.CssMediaType()
+	loadReferencedLocalFiles := s.LoadReferencedLocalFiles()
+	convertExternalLinks := s.ConvertExternalLinks()
+	convertInternalLinks := s.ConvertInternalLinks()
+	convertForms := s.ConvertForms()
+	zoomFactor := s.ZoomFactor()
+	includeInOutline := s.IncludeInOutline()
+	stopSlowScripts := s.StopSlowScripts()
+	username, password := s.BasicAuth()
+	repeatCustomHeaders := s.RepeatCustomHeaders()
+
+	customHeaders := s.CustomHeaders()
+
+	cookies := []CookieProfile{}
+	for _, c := range s.Cookies() {
+		cookies = append(cookies, CookieProfile{Name: c.Name, Value: c.Value})
+	}
+
+	// no proxy is only different from DefaultProxy once it's set
+	var proxy *string
+
+	if s.values.has("load.proxy") {
+		p := ""
+		if u := s.Proxy(); u != nil {
+			if u.User != nil && !secrets {
+				u.User = url.User(u.User.Username())
+			}
+
+			p = u.String()
+		}
+
+		proxy = &p
+	}
+
+	if !secrets {
+		password = ""
+		cookies = nil
+
+		for name := range customHeaders {
+			for _, h := range credentialHeaders {
+				if http.CanonicalHeaderKey(name) == h {
+					delete(customHeaders, name)
+				}
+			}
+		}
+	}
+
+	return &SectionProfile{
+		EnableJavascript:           &enableJavascript,
+		JavascriptDelay:            s.JavascriptDelay().String(),
+		DebugJavascript:            &debugJavascript,
+		EnableImages:               &enableImages,
+		EnableIntelligentShrinking: &enableIntelligentShrinking,
+		CssMediaType:               &cssMediaType,
+		DefaultEncoding:            s.DefaultEncoding(),
+		LoadReferencedLocalFiles:   &loadReferencedLocalFiles,
+		LoadErrorHandling:          s.LoadErrorHandling(),
+		ConvertExternalLinks:       &convertExternalLinks,
+		ConvertInternalLinks:       &convertInternalLinks,
+		ConvertForms:               &convertForms,
+		ZoomFactor:                 &zoomFactor,
+		Header:                     s.Header(),
+		Footer:                     s.Footer(),
+		IncludeInOutline:           &includeInOutline,
+		WindowStatus:               s.WindowStatus(),
+		RunScripts:                 s.RunScripts(),
+		StopSlowScripts:            &stopSlowScripts,
+		Username:                   username,
+		Password:                   password,
+		CustomHeaders:              customHeaders,
+		RepeatCustomHeaders:        &repeatCustomHeaders,
+		PostValues:                 s.PostValues(),
+		Cookies:                    cookies,
+		Proxy:                      proxy,
+	}
+}
+
+// apply sets every field of the profile that isn't omitted
+func (s *sectionSettings) apply(profile *SectionProfile) {
+
+	if profile.EnableJavascript != nil {
+		s.SetEnableJavascript(*profile.EnableJavascript)
+	}
+
+	if profile.JavascriptDelay != "" {
+		delay, err := time.ParseDuration(profile.JavascriptDelay)
+		if err != nil {
+			s.record("load.jsdelay", profile.JavascriptDelay, err)
+		} else {
+			s.SetJavascriptDelay(delay)
+		}
+	}
+
+	if profile.DebugJavascript != nil {
+		s.SetDebugJavascript(*profile.DebugJavascript)
+	}
+
+	if profile.EnableImages != nil {
+		s.SetEnableImages(*profile.EnableImages)
+	}
+
+	if profile.EnableIntelligentShrinking != nil {
+		s.SetEnableIntelligentShrinking(*profile.EnableIntelligentShrinking)
+	}
+
+	if profile.CssMediaType != nil {
+		s.SetCssMediaType(*profile.CssMediaType)
+	}
+
+	if profile.DefaultEncoding != "" {
+		s.SetDefaultEncoding(profile.DefaultEncoding)
+	}
+
+	if profile.LoadReferencedLocalFiles != nil {
+		s.SetLoadReferencedLocalFiles(*profile.LoadReferencedLocalFiles)
+	}
+
+	if profile.LoadErrorHandling != "" {
+		s.SetLoadErrorHandling(profile.LoadErrorHandling)
+	}
+
+	if profile.ConvertExternalLinks != nil {
+		s.SetConvertExternalLinks(*profile.ConvertExternalLinks)
+	}
+
+	if profile.ConvertInternalLinks != nil {
+		s.SetConvertInternalLinks(*profile.ConvertInternalLinks)
+	}
+
+	if profile.ConvertForms != nil {
+		s.SetConvertForms(*profile.ConvertForms)
+	}
+
+	if profile.ZoomFactor != nil {
+		s.SetZoomFactor(*profile.ZoomFactor)
+	}
+
+	if profile.Header != nil {
+		s.SetHeader(profile.Header)
+	}
+
+	if profile.Footer != nil {
+		s.SetFooter(profile.Footer)
+	}
+
+	if profile.IncludeInOutline != nil {
+		s.SetIncludeInOutline(*profile.IncludeInOutline)
+	}
+
+	if profile.WindowStatus != "" {
+		s.SetWindowStatus(profile.WindowStatus)
+	}
+
+	for _, js := range profile.RunScripts {
+		s.AddRunScript(js)
+	}
+
+	if profile.StopSlowScripts != nil {
+		s.SetStopSlowScripts(*profile.StopSlowScripts)
+	}
+
+	if profile.Username != "" || profile.Password != "" {
+		s.SetBasicAuth(profile.Username, profile.Password)
+	}
+
+	if profile.CustomHeaders != nil {
+		s.SetCustomHeaders(http.Header(profile.CustomHeaders))
+	}
+
+	if profile.RepeatCustomHeaders != nil {
+		s.SetRepeatCustomHeaders(*profile.RepeatCustomHeaders)
+	}
+
+	if profile.PostValues != nil {
+		s.SetPostValues(url.Values(profile.PostValues))
+	}
+
+	if profile.Cookies != nil {
+		cookies := []*http.Cookie{}
+		for _, c := range profile.Cookies {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value})
+		}
+
+		s.SetCookies(cookies)
+	}
+
+	if profile.Proxy != nil {
+		if *profile.Proxy == "" {
+			s.SetProxy(nil)
+		} else if u, err := url.Parse(*profile.Proxy); err != nil {
+			// the error repeats the url, which may hold a password
+			s.invalid("load.proxy", "", "invalid url")
+		} else {
+			s.SetProxy(u)
+		}
+	}
+}
+
+func (s *sectionSettings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Profile())
+}
+
+// UnmarshalJSON applies a SectionProfile, unknown keys are an error
+func (s *sectionSettings) UnmarshalJSON(data []byte) error {
+
+	profile := SectionProfile{}
+
+	err := decodeStrict(data, &profile)
+	if err != nil {
+		return err
+	}
+
+	s.apply(&profile)
+
+	return nil
+}
+
+func (c CssMediaType) MarshalText() ([]byte, error) {
+	switch c {
+	case CssMediaTypePrint:
+		return []byte("print"), nil
+	case CssMediaTypeScreen:
+		return []byte("screen"), nil
+	default:
+		return nil, fmt.Errorf("wkhtmltox: unknown css media type %d", int(c))
+	}
+}
+
+func (c *CssMediaType) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "print":
+		*c = CssMediaTypePrint
+	case "screen":
+		*c = CssMediaTypeScreen
+	default:
+		return errors.New("wkhtmltox: unknown css media type '" + string(text) + "', expecting print or screen")
+	}
+
+	return nil
+}
+
+func (w WarningPolicy) MarshalText() ([]byte, error) {
+	switch w {
+	case WarningPolicyIgnore:
+		return []byte("ignore"), nil
+	case WarningPolicyFatal:
+		return []byte("fatal"), nil
+	default:
+		return nil, fmt.Errorf("wkhtmltox: unknown warning policy %d", int(w))
+	}
+}
+
+func (w *WarningPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "ignore":
+		*w = WarningPolicyIgnore
+	case "fatal":
+		*w = WarningPolicyFatal
+	default:
+		return errors.New("wkhtmltox: unknown warning policy '" + string(text) + "', expecting ignore or fatal")
+	}
+
+	return nil
+}
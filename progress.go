@@ -0,0 +1,93 @@
+package wkhtmltox
+
+import (
+	"sync"
+)
+
+// Progress is reported while a conversion is running
+type Progress struct {
+
+	// the progress of the current phase, 0 - 100
+	Percent int
+
+	// the index of the current phase, 0 <= Phase < PhaseCount
+	Phase            int
+	PhaseCount       int
+	PhaseDescription string
+}
+
+// progressQueue hands progress events from the backend to a handler running on its own go-routine,
+// so a slow handler never holds up the conversion.
+type progressQueue struct {
+	handler func(Progress)
+
+	mu      sync.Mutex
+	pending []Progress
+	closed  bool
+
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func newProgressQueue(handler func(Progress)) *progressQueue {
+	q := &progressQueue{
+		handler: handler,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	go q.run()
+
+	return q
+}
+
+func (q *progressQueue) push(p Progress) {
+	q.mu.Lock()
+
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+
+	q.pending = append(q.pending, p)
+	q.mu.Unlock()
+
+	q.wake()
+}
+
+// close stops accepting events and waits for the queued ones to be handled
+func (q *progressQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.wake()
+	<-q.done
+}
+
+func (q *progressQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *progressQueue) run() {
+	defer close(q.done)
+
+	for range q.notify {
+		q.mu.Lock()
+		pending := q.pending
+		closed := q.closed
+		q.pending = nil
+		q.mu.Unlock()
+
+		for _, p := range pending {
+			q.handler(p)
+		}
+
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package wkhtmltox
+
+import (
+	"errors"
+)
+
+// ErrRejectedSetting is wrapped by a *SettingError when wkhtmltopdf doesn't know a setting,
+// or doesn't accept its value when the document is converted
+var ErrRejectedSetting = errors.New("rejected by wkhtmltopdf")
+
+// SettingError is recorded by a setter when its value can't be applied
+type SettingError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *SettingError) Error() string {
+	return "wkhtmltox: setting " + e.Key + "='" + e.Value + "': " + e.Err.Error()
+}
+
+func (e *SettingError) Unwrap() error {
+	return e.Err
+}
+
+// settingErrors records the errors of setters, which don't return them.
+// They're reported by Err and Validate, and checked before the settings are used.
+type settingErrors struct {
+	errs []error
+}
+
+func (s *settingErrors) record(key, value string, err error) {
+	if err == nil {
+		return
+	}
+
+	s.errs = append(s.errs, &SettingError{
+		Key:   key,
+		Value: value,
+		Err:   err,
+	})
+}
+
+// records that a value was rejected before it reached wkhtmltopdf
+func (s *settingErrors) invalid(key, value, reason string) {
+	s.record(key, value, errors.New(reason))
+}
+
+// Err returns the first error recorded by a setter, or nil
+func (s *settingErrors) Err() error {
+	if len(s.errs) == 0 {
+		return nil
+	}
+
+	return s.errs[0]
+}
+
+// Validate returns every error recorded by a setter, or nil
+func (s *settingErrors) Validate() error {
+	return errors.Join(s.errs...)
+}
+
+// copy returns a copy that doesn't share its errors with s
+func (s *settingErrors) copy() settingErrors {
+	return settingErrors{errs: append([]error(nil), s.errs...)}
+}
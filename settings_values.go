@@ -0,0 +1,393 @@
+package wkhtmltox
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// the global settings known to wkhtmltopdf, as listed in
+// https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pagePdfGlobal
+var globalSettingKeys = []string{
+	"size.paperSize",
+	"size.width",
+	"size.height",
+	"orientation",
+	"colorMode",
+	"resolution",
+	"dpi",
+	"pageOffset",
+	"copies",
+	"collate",
+	"outline",
+	"outlineDepth",
+	"dumpOutline",
+	"out",
+	"documentTitle",
+	"useCompression",
+	"margin.top",
+	"margin.bottom",
+	"margin.left",
+	"margin.right",
+	"imageDPI",
+	"imageQuality",
+	"load.cookieJar",
+	"viewportSize",
+}
+
+// the object settings known to wkhtmltopdf, as listed in
+// https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pagePdfObject
+var objectSettingKeys = []string{
+	"toc.useDottedLines",
+	"toc.captionText",
+	"toc.forwardLinks",
+	"toc.backLinks",
+	"toc.indentation",
+	"toc.fontScale",
+	"page",
+	"header.fontSize",
+	"header.fontName",
+	"header.left",
+	"header.center",
+	"header.right",
+	"header.line",
+	"header.spacing",
+	"header.htmlUrl",
+	"footer.fontSize",
+	"footer.fontName",
+	"footer.left",
+	"footer.center",
+	"footer.right",
+	"footer.line",
+	"footer.spacing",
+	"footer.htmlUrl",
+	"useExternalLinks",
+	"useLocalLinks",
+	"produceForms",
+	"load.username",
+	"load.password",
+	"load.jsdelay",
+	"load.zoomFactor",
+	"load.customHeaders",
+	"load.repeatCustomHeaders",
+	"load.cookies",
+	"load.post",
+	"load.blockLocalFileAccess",
+	"load.stopSlowScript",
+	"load.debugJavascript",
+	"load.loadErrorHandling",
+	"load.proxy",
+	"load.runScript",
+	"load.windowStatus",
+	"web.background",
+	"web.loadImages",
+	"web.enableJavascript",
+	"web.enableIntelligentShrinking",
+	"web.minimumFontSize",
+	"web.printMediaType",
+	"web.defaultEncoding",
+	"web.userStyleSheet",
+	"web.enablePlugins",
+	"includeInOutline",
+	"pagesCount",
+	"tocXsl",
+	"isTableOfContent",
+}
+
+// the settings this package applies on top of wkhtmltopdf's defaults, before the values of the setters
+var packageGlobalSettings = []settingValue{
+	{key: "viewportSize", value: "1280x800"},
+	{key: "orientation", value: string(Landscape)},
+	{key: "colorMode", value: string(ColorModeColor)},
+	{key: "size.paperSize", value: string(PageSizeA4)},
+}
+
+// none, viewportSize is a global setting and libwkhtmltox rejects it on objects
+var packageObjectSettings []settingValue
+
+var packageImageSettings = []settingValue{
+	{key: "fmt", value: string(ImageFormatPng)},
+}
+
+// wkhtmltopdf's defaults of the global settings, as returned by the getters if a setting isn't set
+var globalSettingDefaults = map[string]string{
+	"size.paperSize": string(PageSizeA4),
+	"orientation":    string(Portrait),
+	"colorMode":      string(ColorModeColor),
+	"dpi":            "96",
+	"pageOffset":     "0",
+	"copies":         "1",
+	"collate":        "true",
+	"outline":        "true",
+	"outlineDepth":   "4",
+	"useCompression": "true",
+	"imageDPI":       "600",
+	"imageQuality":   "94",
+	"margin.top":     "10mm",
+	"margin.bottom":  "10mm",
+	"margin.left":    "10mm",
+	"margin.right":   "10mm",
+}
+
+// wkhtmltopdf's defaults of the object settings, as returned by the getters if a setting isn't set
+var objectSettingDefaults = map[string]string{
+	"toc.useDottedLines":             "true",
+	"toc.captionText":                "Table of Contents",
+	"toc.forwardLinks":               "true",
+	"toc.backLinks":                  "false",
+	"toc.indentation":                "1em",
+	"toc.fontScale":                  "0.8",
+	"header.fontSize":                "12",
+	"header.fontName":                "Arial",
+	"header.line":                    "false",
+	"header.spacing":                 "0",
+	"footer.fontSize":                "12",
+	"footer.fontName":                "Arial",
+	"footer.line":                    "false",
+	"footer.spacing":                 "0",
+	"useExternalLinks":               "true",
+	"useLocalLinks":                  "true",
+	"produceForms":                   "false",
+	"load.jsdelay":                   "200",
+	"load.zoomFactor":                "1",
+	"load.repeatCustomHeaders":       "false",
+	"load.blockLocalFileAccess":      "false",
+	"load.stopSlowScript":            "true",
+	"load.debugJavascript":           "false",
+	"load.loadErrorHandling":         string(LoadErrorHandleMethodAbort),
+	"web.background":                 "true",
+	"web.loadImages":                 "true",
+	"web.enableJavascript":           "true",
+	"web.enableIntelligentShrinking": "true",
+	"web.minimumFontSize":            "-1",
+	"web.printMediaType":             "false",
+	"web.enablePlugins":              "false",
+	"includeInOutline":               "true",
+	"pagesCount":                     "true",
+	"isTableOfContent":               "false",
+}
+
+// the image settings known to wkhtmltoimage, as listed in
+// https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pageImageGlobal
+var imageSettingKeys = []string{
+	"crop.left",
+	"crop.top",
+	"crop.width",
+	"crop.height",
+	"load.cookieJar",
+	"load.username",
+	"load.password",
+	"load.jsdelay",
+	"load.zoomFactor",
+	"load.blockLocalFileAccess",
+	"load.stopSlowScript",
+	"load.debugJavascript",
+	"load.loadErrorHandling",
+	"load.proxy",
+	"web.background",
+	"web.loadImages",
+	"web.enableJavascript",
+	"web.enableIntelligentShrinking",
+	"web.minimumFontSize",
+	"web.printMediaType",
+	"web.defaultEncoding",
+	"web.userStyleSheet",
+	"web.enablePlugins",
+	"transparent",
+	"in",
+	"out",
+	"fmt",
+	"screenWidth",
+	"smartWidth",
+	"quality",
+}
+
+func knownKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the effective value of a setting: set by a setter, by this package or wkhtmltopdf's default
+func lookup(values settingValues, pkg []settingValue, defaults map[string]string, key string) (string, bool) {
+
+	if value, ok := values.get(key); ok {
+		return value, true
+	}
+
+	for _, s := range pkg {
+		if s.key == key {
+			return s.value, true
+		}
+	}
+
+	value, ok := defaults[key]
+
+	return value, ok
+}
+
+// snapshot returns the value of every key that has one, with the secrets redacted
+func snapshot(keys []string, lookup func(string) (string, bool)) map[string]string {
+
+	values := map[string]string{}
+
+	for _, key := range keys {
+		value, ok := lookup(key)
+		if !ok {
+			continue
+		}
+
+		values[key] = redact(key, value)
+	}
+
+	return values
+}
+
+// redact hides the secret in the value of key, e.g. before it's logged
+func redact(key, value string) string {
+
+	if strings.HasSuffix(key, "password") {
+		return "***"
+	}
+
+	if key == "load.proxy" {
+		if u, err := url.Parse(value); err == nil {
+			return u.Redacted()
+		}
+	}
+
+	return value
+}
+
+func parseBool(value string) bool {
+	b, _ := strconv.ParseBool(strings.TrimSpace(value))
+	return b
+}
+
+func parseInt(value string) int {
+	i, _ := strconv.Atoi(strings.TrimSpace(value))
+	return i
+}
+
+func parseFloat(value string) float32 {
+	f, _ := strconv.ParseFloat(strings.TrimSpace(value), 32)
+	return float32(f)
+}
+
+func parseLength(value string) Length {
+	l, _ := ParseLength(strings.TrimSpace(value))
+	return l
+}
+
+// settingValue is a value applied by a setter
+type settingValue struct {
+	key   string
+	value string
+
+	// the settings a list setting is applied with instead of key=value, in order
+	list []settingValue
+}
+
+// settingValues records the values applied by setters in order.
+// They're applied to wkhtmltopdf's settings by the Backend when the document is converted,
+// so settings can be copied, shared and used without cgo.
+type settingValues struct {
+	list []settingValue
+}
+
+// put records value, replacing an earlier value of key
+func (v *settingValues) put(key, value string) {
+	for i, s := range v.list {
+		if s.key == key {
+			v.list = append(v.list[:i:i], v.list[i+1:]...)
+			break
+		}
+	}
+
+	v.list = append(v.list, settingValue{key: key, value: value})
+}
+
+// has returns whether or not a value of key is recorded
+func (v settingValues) has(key string) bool {
+	for _, s := range v.list {
+		if s.key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// get returns the recorded value of key
+func (v settingValues) get(key string) (string, bool) {
+	for _, s := range v.list {
+		if s.key == key && s.list == nil {
+			return s.value, true
+		}
+	}
+
+	return "", false
+}
+
+// putList records the settings that make up the list setting key, replacing an earlier value of key
+func (v *settingValues) putList(key string, list []settingValue) {
+	v.put(key, "")
+	v.list[len(v.list)-1].list = list
+}
+
+// getList returns the settings that make up the list setting key, or nil
+func (v settingValues) getList(key string) []settingValue {
+	for _, s := range v.list {
+		if s.key == key {
+			return s.list
+		}
+	}
+
+	return nil
+}
+
+// merge records every value of other, replacing earlier values of the same keys
+func (v *settingValues) merge(other settingValues) {
+	for _, s := range other.list {
+		v.put(s.key, s.value)
+		v.list[len(v.list)-1].list = s.list
+	}
+}
+
+// copy returns a copy that doesn't share its list with v
+func (v settingValues) copy() settingValues {
+	return settingValues{list: append([]settingValue(nil), v.list...)}
+}
+
+// flatten returns the settings in the order they're applied to wkhtmltopdf,
+// starting with this package's defaults pkg, and with list settings expanded to their elements
+func (v settingValues) flatten(pkg []settingValue) []settingValue {
+
+	flat := append([]settingValue(nil), pkg...)
+
+	for _, s := range v.list {
+		if s.list == nil {
+			flat = append(flat, s)
+		} else {
+			flat = append(flat, s.list...)
+		}
+	}
+
+	return flat
+}
+
+// applyTo applies the settings with set, e.g. to wkhtmltopdf's settings, and returns a *SettingError for the first it rejects
+func applyTo(settings []settingValue, set func(key, value string) error) error {
+
+	for _, s := range settings {
+		if set(s.key, s.value) != nil {
+			return &SettingError{Key: s.key, Value: redact(s.key, s.value), Err: ErrRejectedSetting}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package wkhtmltox
+
+// TocSettings configures a table of contents section.
+// For the list of settings see https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pagePdfObject
+type TocSettings struct {
+
+	// the caption of the table of contents
+	CaptionText string
+
+	// whether or not to draw dotted lines between the headings and the page numbers
+	UseDottedLines bool
+
+	// whether or not the headings link to the content
+	ForwardLinks bool
+
+	// whether or not the content headings link back to the table of contents
+	BackLinks bool
+
+	// the indentation per heading level, e.g. "1em"
+	Indentation string
+
+	// the factor the font is scaled by per heading level, e.g. 0.8
+	FontScale float32
+
+	// url of an xsl stylesheet used to render the table of contents
+	XslUrl string
+
+	// xsl stylesheet used to render the table of contents, takes precedence over XslUrl.
+	// It's written to a temporary file that is removed after Convert.
+	Xsl string
+}
+
+// NewTocSettings returns table of contents settings with the wkhtmltopdf defaults
+func NewTocSettings() *TocSettings {
+	return &TocSettings{
+		CaptionText:    "Table of Contents",
+		UseDottedLines: true,
+		ForwardLinks:   true,
+		BackLinks:      false,
+		Indentation:    "1em",
+		FontScale:      0.8,
+	}
+}
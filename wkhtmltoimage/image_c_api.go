@@ -0,0 +1,353 @@
+// wkhtmltoimage forms cgo bindings for the wkhtmltoimage C-API (wkhtmltox/image.h).
+//
+// Calls into the C library run on the render thread owned by the wkhtmltopdf package,
+// which libwkhtmltox requires to be the same for pdf and image conversions.
+// It's initialized and shut down along with the wkhtmltopdf package.
+package wkhtmltoimage
+
+//#cgo CFLAGS: -I/usr/local/include
+//#cgo LDFLAGS: -L/usr/local/lib -lwkhtmltox -Wall -ansi -pedantic -ggdb
+//#include <stdbool.h>
+//#include <stdio.h>
+//#include <string.h>
+//#include <stdlib.h>
+//#include <wkhtmltox/image.h>
+//extern void image_finished_cb(void*, const int);
+//extern void image_progress_changed_cb(void*, const int);
+//extern void image_error_cb(void*, char *msg);
+//extern void image_warning_cb(void*, char *msg);
+//extern void image_phase_changed_cb(void*);
+//static void setup_callbacks(wkhtmltoimage_converter * c) {
+//  wkhtmltoimage_set_finished_callback(c, (wkhtmltoimage_int_callback)image_finished_cb);
+//  wkhtmltoimage_set_progress_changed_callback(c, (wkhtmltoimage_int_callback)image_progress_changed_cb);
+//  wkhtmltoimage_set_error_callback(c, (wkhtmltoimage_str_callback)image_error_cb);
+//  wkhtmltoimage_set_warning_callback(c, (wkhtmltoimage_str_callback)image_warning_cb);
+//  wkhtmltoimage_set_phase_changed_callback(c, (wkhtmltoimage_void_callback)image_phase_changed_cb);
+//}
+import "C"
+
+import (
+	"context"
+	"errors"
+	"github.com/nbosscher/wkhtmltox/wkhtmltopdf"
+	"sync"
+	"unsafe"
+)
+
+type GlobalSettings struct {
+	s *C.wkhtmltoimage_global_settings
+}
+
+type Converter struct {
+	c               *C.wkhtmltoimage_converter
+	Finished        func(*Converter, int)
+	ProgressChanged func(*Converter, int)
+	Error           func(*Converter, string)
+	Warning         func(*Converter, string)
+	Phase           func(*Converter)
+	converted       bool
+	destroyed       bool
+}
+
+// converter_map routes the callbacks, which only get the C converter, to the converter being converted.
+// It's guarded by converterMu, so a callback that fires after its converter is gone finds nil.
+var (
+	converterMu   sync.RWMutex
+	converter_map map[unsafe.Pointer]*Converter
+)
+
+func init() {
+	converter_map = map[unsafe.Pointer]*Converter{}
+
+	// initialized and deinitialized along with wkhtmltopdf, see wkhtmltopdf.Init and wkhtmltopdf.Shutdown
+	wkhtmltopdf.RegisterLibrary(func(useGraphics bool) {
+		if useGraphics {
+			C.wkhtmltoimage_init(C.true)
+		} else {
+			C.wkhtmltoimage_init(C.false)
+		}
+	}, func() {
+		C.wkhtmltoimage_deinit()
+	})
+}
+
+func NewGlobalSettings() *GlobalSettings {
+	var s *C.wkhtmltoimage_global_settings
+
+	wkhtmltopdf.Do(func() {
+		s = C.wkhtmltoimage_create_global_settings()
+	})
+
+	return &GlobalSettings{s: s}
+}
+
+// See https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pageImageGlobal for more settings
+func (self *GlobalSettings) Set(name, value string) error {
+	c_name := C.CString(name)
+	c_value := C.CString(value)
+
+	defer C.free(unsafe.Pointer(c_name))
+	defer C.free(unsafe.Pointer(c_value))
+
+	var i C.int
+	wkhtmltopdf.Do(func() {
+		i = C.wkhtmltoimage_set_global_setting(self.s, c_name, c_value)
+	})
+
+	if i != C.int(1) {
+		return errors.New("wkhtmltoimage-globalsettings: set property '" + name + "' failed")
+	}
+
+	return nil
+}
+
+func (self *GlobalSettings) Get(name string) (string, error) {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	// wkhtmltoimage truncates values that don't fit, so a value that fills the buffer is read again with a larger one
+	for size := 256; ; size *= 2 {
+		c_value := (*C.char)(C.calloc(C.size_t(size), 1))
+
+		var i C.int
+		wkhtmltopdf.Do(func() {
+			i = C.wkhtmltoimage_get_global_setting(self.s, c_name, c_value, C.int(size))
+		})
+
+		if i != C.int(1) {
+			C.free(unsafe.Pointer(c_value))
+			return "", errors.New("wkhtmltoimage-globalsettings: null value")
+		}
+
+		n := int(C.strlen(c_value))
+		if n < size-1 {
+			value := C.GoStringN(c_value, C.int(n))
+			C.free(unsafe.Pointer(c_value))
+
+			return value, nil
+		}
+
+		C.free(unsafe.Pointer(c_value))
+	}
+}
+
+// NewConverter creates a converter for data.
+// Pass an empty string to convert the page set with the "in" setting instead.
+func (self *GlobalSettings) NewConverter(data string) *Converter {
+	c := &Converter{}
+
+	var c_data *C.char
+	if data != "" {
+		c_data = C.CString(data)
+		defer C.free(unsafe.Pointer(c_data))
+	}
+
+	wkhtmltopdf.Do(func() {
+		c.c = C.wkhtmltoimage_create_converter(self.s, c_data)
+		C.setup_callbacks(c.c)
+	})
+
+	return c
+}
+
+func registerConverter(conv *Converter) {
+	converterMu.Lock()
+	converter_map[unsafe.Pointer(conv.c)] = conv
+	converterMu.Unlock()
+}
+
+func unregisterConverter(conv *Converter) {
+	converterMu.Lock()
+	delete(converter_map, unsafe.Pointer(conv.c))
+	converterMu.Unlock()
+}
+
+// lookupConverter returns the converter being converted by c, or nil
+func lookupConverter(c unsafe.Pointer) *Converter {
+	converterMu.RLock()
+	defer converterMu.RUnlock()
+
+	return converter_map[c]
+}
+
+//export image_finished_cb
+func image_finished_cb(c unsafe.Pointer, s C.int) {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Finished != nil {
+		conv.Finished(conv, int(s))
+	}
+}
+
+//export image_progress_changed_cb
+func image_progress_changed_cb(c unsafe.Pointer, p C.int) {
+	conv := lookupConverter(c)
+	if conv != nil && conv.ProgressChanged != nil {
+		conv.ProgressChanged(conv, int(p))
+	}
+}
+
+//export image_error_cb
+func image_error_cb(c unsafe.Pointer, msg *C.char) {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Error != nil {
+		conv.Error(conv, C.GoString(msg))
+	}
+}
+
+//export image_warning_cb
+func image_warning_cb(c unsafe.Pointer, msg *C.char) {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Warning != nil {
+		conv.Warning(conv, C.GoString(msg))
+	}
+}
+
+//export image_phase_changed_cb
+func image_phase_changed_cb(c unsafe.Pointer) {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Phase != nil {
+		conv.Phase(conv)
+	}
+}
+
+// Convert runs the conversion on the render thread.
+// Callbacks are invoked on the render thread while Convert is running.
+func (self *Converter) Convert() bool {
+
+	var ok bool
+
+	wkhtmltopdf.Do(func() {
+		ok = self.convert()
+	})
+
+	return ok
+}
+
+// ConvertContext is like Convert, but returns ctx.Err() if ctx is done before the conversion completes.
+//
+// libwkhtmltox can't interrupt a conversion that has started, so it is abandoned instead:
+// it runs to completion on the render thread, after which the converter is destroyed and its output discarded.
+// A conversion that hasn't started when ctx is done is never started.
+// After ConvertContext returns a context error the converter belongs to this package and must not be used again.
+//
+// There's a single render thread, so an abandoned conversion keeps it busy: a page that hangs
+// blocks every later conversion. For cancellation that stops the conversion use IsolatedBackend
+// or Pool of the wkhtmltox package, which kill the child process converting it.
+func (self *Converter) ConvertContext(ctx context.Context) (bool, error) {
+
+	var ok bool
+
+	err := wkhtmltopdf.DoContext(ctx, func() {
+		ok = self.convert()
+	})
+
+	if err != nil {
+		// queued behind the conversion, so it runs once the render thread is done with it
+		go self.Destroy()
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// convert must be called on the render thread
+func (self *Converter) convert() bool {
+
+	registerConverter(self)
+	defer unregisterConverter(self)
+
+	status := C.wkhtmltoimage_convert(self.c)
+
+	if status != C.int(1) {
+		return false
+	}
+
+	self.converted = true
+
+	return true
+}
+
+// CurrentPhase returns the index of the phase the conversion is in
+func (self *Converter) CurrentPhase() int {
+	var phase C.int
+
+	wkhtmltopdf.Do(func() {
+		phase = C.wkhtmltoimage_current_phase(self.c)
+	})
+
+	return int(phase)
+}
+
+// PhaseCount returns the number of phases the conversion goes through
+func (self *Converter) PhaseCount() int {
+	var count C.int
+
+	wkhtmltopdf.Do(func() {
+		count = C.wkhtmltoimage_phase_count(self.c)
+	})
+
+	return int(count)
+}
+
+// PhaseDescription returns a human readable description of the phase at index
+func (self *Converter) PhaseDescription(phase int) string {
+	var desc string
+
+	wkhtmltopdf.Do(func() {
+		desc = C.GoString(C.wkhtmltoimage_phase_description(self.c, C.int(phase)))
+	})
+
+	return desc
+}
+
+func (self *Converter) ErrorCode() int {
+	var code C.int
+
+	wkhtmltopdf.Do(func() {
+		code = C.wkhtmltoimage_http_error_code(self.c)
+	})
+
+	return int(code)
+}
+
+// OutputAsBuffer retrieves the converted result as a byte array.
+// If .Convert has not been called, this method will call it
+func (self *Converter) OutputAsBuffer() ([]byte, error) {
+
+	if !self.converted {
+		ok := self.Convert()
+		if !ok {
+			return nil, errors.New("wkhtmltoimage: conversion failed")
+		}
+	}
+
+	var buf []byte
+	ran := false
+
+	wkhtmltopdf.Do(func() {
+		ran = true
+
+		var cBuf *C.uchar
+
+		bufLen := C.int(C.wkhtmltoimage_get_output(self.c, &cBuf))
+		buf = C.GoBytes(unsafe.Pointer(cBuf), bufLen)
+	})
+
+	if !ran {
+		return nil, wkhtmltopdf.ErrShutdown
+	}
+
+	return buf, nil
+}
+
+// Destroy frees the converter. Calling Destroy more than once is a no-op.
+func (self *Converter) Destroy() {
+	wkhtmltopdf.Do(func() {
+		if self.destroyed {
+			return
+		}
+
+		C.wkhtmltoimage_destroy_converter(self.c)
+		self.destroyed = true
+	})
+}
@@ -1,3 +1,8 @@
+// wkhtmltopdf forms cgo bindings for the wkhtmltopdf C-API (wkhtmltox/pdf.h).
+//
+// All calls into the C library are made from a single locked OS thread owned by this package,
+// so the API is safe to use from any goroutine.
+// The thread and libwkhtmltox are started by Init, or by the first call that needs them, and stopped by Shutdown.
 package wkhtmltopdf
 
 //#cgo CFLAGS: -I/usr/local/include
@@ -19,10 +24,16 @@ package wkhtmltopdf
 //  wkhtmltopdf_set_warning_callback(c, (wkhtmltopdf_str_callback)warning_cb);
 //  wkhtmltopdf_set_phase_changed_callback(c, (wkhtmltopdf_void_callback)phase_changed_cb);
 //}
+//static __thread int render_thread;
+//static void mark_render_thread() { render_thread = 1; }
+//static int is_render_thread() { return render_thread; }
 import "C"
 
 import (
+	"context"
 	"errors"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
@@ -42,17 +53,302 @@ type Converter struct {
 	Warning         func(*Converter, string)
 	Phase           func(*Converter)
 	converted       bool
+	destroyed       bool
 }
 
-var converter_map map[unsafe.Pointer]*Converter
+// converter_map routes the callbacks, which only get the C converter, to the converter being converted.
+// It's guarded by converterMu, so a callback that fires after its converter is gone finds nil.
+var (
+	converterMu   sync.RWMutex
+	converter_map map[unsafe.Pointer]*Converter
+)
+
+// Options configures libwkhtmltox, see Init
+type Options struct {
+
+	// let Qt use the graphics system, e.g. an X server, which some features need. Default false
+	UseGraphics bool
+}
+
+var (
+	// returned by Init if libwkhtmltox is already initialized, e.g. lazily by an earlier call
+	ErrInitialized = errors.New("wkhtmltopdf: already initialized")
+
+	// returned once libwkhtmltox is shut down, it can't be initialized again
+	ErrShutdown = errors.New("wkhtmltopdf: shut down")
+)
+
+const (
+	stateNew = iota
+	stateRunning
+	stateShutdown
+)
+
+// lifecycle guards state, options and libraries. do holds it for reading while it waits for the render thread,
+// so Shutdown waits for the calls that are running.
+var (
+	lifecycle sync.RWMutex
+	state     = stateNew
+	options   Options
+	libraries []library
+)
+
+// library is another part of libwkhtmltox, e.g. wkhtmltoimage, see RegisterLibrary
+type library struct {
+	init   func(useGraphics bool)
+	deinit func()
+}
+
+// calls carries work to the render thread.
+// Qt requires every wkhtmltopdf call to happen on the thread that ran wkhtmltopdf_init,
+// so the package owns a locked OS thread and all public functions are executed on it.
+var calls = make(chan func())
 
 func init() {
 	converter_map = map[unsafe.Pointer]*Converter{}
-	C.wkhtmltopdf_init(C.false)
+}
+
+// Init starts the render thread and initializes libwkhtmltox with opts.
+// Calling it is optional, the first call that needs libwkhtmltox initializes it with the default options.
+// It returns ErrInitialized if libwkhtmltox is already initialized, and ErrShutdown after Shutdown.
+func Init(opts Options) error {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	switch state {
+	case stateRunning:
+		return ErrInitialized
+	case stateShutdown:
+		return ErrShutdown
+	}
+
+	start(opts)
+
+	return nil
+}
+
+// Shutdown waits for the running calls, deinitializes libwkhtmltox and stops the render thread.
+// Qt can't be initialized twice, so afterwards the calls of this package fail, e.g. Convert returns false.
+// Calling Shutdown more than once is a no-op.
+func Shutdown() {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	if state == stateRunning {
+		done := make(chan struct{})
+
+		calls <- func() {
+			defer close(done)
+
+			for i := len(libraries) - 1; i >= 0; i-- {
+				libraries[i].deinit()
+			}
+
+			C.wkhtmltopdf_deinit()
+		}
+
+		<-done
+		close(calls)
+	}
+
+	state = stateShutdown
+}
+
+// IsShutdown reports whether Shutdown was called
+func IsShutdown() bool {
+	lifecycle.RLock()
+	defer lifecycle.RUnlock()
+
+	return state == stateShutdown
+}
+
+// RegisterLibrary registers the init and deinit functions of another part of libwkhtmltox (e.g. wkhtmltoimage).
+// They're run on the render thread, init right after wkhtmltopdf_init, or right away if it already ran,
+// and deinit before wkhtmltopdf_deinit.
+func RegisterLibrary(init func(useGraphics bool), deinit func()) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	libraries = append(libraries, library{init: init, deinit: deinit})
+
+	if state == stateRunning {
+		done := make(chan struct{})
+
+		calls <- func() {
+			defer close(done)
+			init(options.UseGraphics)
+		}
+
+		<-done
+	}
+}
+
+// Version returns the version of libwkhtmltox, it doesn't need libwkhtmltox to be initialized
+func Version() string {
+	return C.GoString(C.wkhtmltopdf_version())
+}
+
+// ExtendedQt reports whether libwkhtmltox is built against the patched Qt,
+// which some features (e.g. headers, footers and the outline) require
+func ExtendedQt() bool {
+	return C.wkhtmltopdf_extended_qt() != 0
+}
+
+// start must be called with lifecycle locked
+func start(opts Options) {
+	options = opts
+
+	ready := make(chan struct{})
+	go renderThread(ready)
+	<-ready
+
+	state = stateRunning
+}
+
+// renderThread is started with lifecycle locked, it reads options and libraries before it's ready
+func renderThread(ready chan struct{}) {
+	runtime.LockOSThread()
+
+	useGraphics := C.int(0)
+	if options.UseGraphics {
+		useGraphics = 1
+	}
+
+	C.mark_render_thread()
+	C.wkhtmltopdf_init(useGraphics)
+
+	for _, l := range libraries {
+		l.init(options.UseGraphics)
+	}
+
+	close(ready)
+
+	for fn := range calls {
+		fn()
+	}
+}
+
+// acquire locks lifecycle for reading, initializing libwkhtmltox if nothing did yet.
+// It returns false, and doesn't lock, after Shutdown.
+func acquire() bool {
+	for {
+		lifecycle.RLock()
+
+		switch state {
+		case stateRunning:
+			return true
+		case stateShutdown:
+			lifecycle.RUnlock()
+			return false
+		}
+
+		lifecycle.RUnlock()
+		lifecycle.Lock()
+
+		if state == stateNew {
+			start(Options{})
+		}
+
+		lifecycle.Unlock()
+	}
+}
+
+// do runs fn on the render thread and waits for it to return.
+// When called from the render thread itself (e.g. from inside a callback) fn is run directly.
+// After Shutdown fn isn't run.
+func do(fn func()) {
+	if C.is_render_thread() != 0 {
+		fn()
+		return
+	}
+
+	if !acquire() {
+		return
+	}
+
+	defer lifecycle.RUnlock()
+
+	done := make(chan struct{})
+
+	calls <- func() {
+		defer close(done)
+		fn()
+	}
+
+	<-done
+}
+
+// doContext is like do, but returns ctx.Err() if ctx is done before fn returns, and ErrShutdown after Shutdown.
+// fn isn't run if ctx is done before the render thread gets to it, once started it always runs to completion.
+func doContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if C.is_render_thread() != 0 {
+		fn()
+		return nil
+	}
+
+	if !acquire() {
+		return ErrShutdown
+	}
+
+	defer lifecycle.RUnlock()
+
+	done := make(chan struct{})
+	ran := false
+
+	job := func() {
+		defer close(done)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		fn()
+		ran = true
+	}
+
+	select {
+	case calls <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		if !ran {
+			return ctx.Err()
+		}
+
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do runs fn on the render thread and waits for it to return.
+// It's meant for bindings of other parts of libwkhtmltox (e.g. wkhtmltoimage),
+// which have to run on the same thread as wkhtmltopdf.
+func Do(fn func()) {
+	do(fn)
+}
+
+// DoContext is like Do, but returns ctx.Err() if ctx is done before fn returns, and ErrShutdown after Shutdown.
+// fn isn't run if ctx is done before the render thread gets to it, once started it always runs to completion.
+func DoContext(ctx context.Context, fn func()) error {
+	return doContext(ctx, fn)
 }
 
 func NewGlobalSettings() *GlobalSettings {
-	return &GlobalSettings{s: C.wkhtmltopdf_create_global_settings()}
+	var s *C.wkhtmltopdf_global_settings
+
+	do(func() {
+		s = C.wkhtmltopdf_create_global_settings()
+	})
+
+	return &GlobalSettings{s: s}
 }
 
 // See https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pagePdfGlobal for more settings
@@ -63,7 +359,10 @@ func (self *GlobalSettings) Set(name, value string) error {
 	defer C.free(unsafe.Pointer(c_name))
 	defer C.free(unsafe.Pointer(c_value))
 
-	i := C.wkhtmltopdf_set_global_setting(self.s, c_name, c_value)
+	var i C.int
+	do(func() {
+		i = C.wkhtmltopdf_set_global_setting(self.s, c_name, c_value)
+	})
 
 	if i != C.int(1) {
 		return errors.New("wkhtml2pdf-globalsettings: set property '" + name + "' failed")
@@ -74,87 +373,213 @@ func (self *GlobalSettings) Set(name, value string) error {
 
 func (self *GlobalSettings) Get(name string) (string, error) {
 	c_name := C.CString(name)
-
-	buf := "<allocate-a-c-string-buffer----------------->"
-	c_value := C.CString(buf)
-
 	defer C.free(unsafe.Pointer(c_name))
-	defer C.free(unsafe.Pointer(c_value))
 
-	i := C.wkhtmltopdf_get_global_setting(self.s, c_name, c_value, C.int(len(buf)))
-	if i != C.int(1) {
+	value, ok := getSetting(func(c_value *C.char, size C.int) C.int {
+		return C.wkhtmltopdf_get_global_setting(self.s, c_name, c_value, size)
+	})
+
+	if !ok {
 		return "", errors.New("wkhtml2pdf-globalsettings: null value")
 	}
 
-	return C.GoString(c_value), nil
+	return value, nil
+}
+
+// getSetting reads a setting using get, which copies the value into a buffer of the given size.
+// wkhtmltopdf truncates values that don't fit, so a value that fills the buffer is read again with a larger one.
+func getSetting(get func(c_value *C.char, size C.int) C.int) (string, bool) {
+
+	for size := 256; ; size *= 2 {
+		c_value := (*C.char)(C.calloc(C.size_t(size), 1))
+
+		var i C.int
+		do(func() {
+			i = get(c_value, C.int(size))
+		})
+
+		if i != C.int(1) {
+			C.free(unsafe.Pointer(c_value))
+			return "", false
+		}
+
+		n := int(C.strlen(c_value))
+		if n < size-1 {
+			value := C.GoStringN(c_value, C.int(n))
+			C.free(unsafe.Pointer(c_value))
+
+			return value, true
+		}
+
+		C.free(unsafe.Pointer(c_value))
+	}
 }
 
 func NewObjectSettings() *ObjectSettings {
-	return &ObjectSettings{s: C.wkhtmltopdf_create_object_settings()}
+	var s *C.wkhtmltopdf_object_settings
+
+	do(func() {
+		s = C.wkhtmltopdf_create_object_settings()
+	})
+
+	return &ObjectSettings{s: s}
 }
 
-func (self *ObjectSettings) Set(name, value string) {
+// See https://wkhtmltopdf.org/libwkhtmltox/pagesettings.html#pagePdfObject for more settings
+func (self *ObjectSettings) Set(name, value string) error {
 	c_name := C.CString(name)
 	c_value := C.CString(value)
 	defer C.free(unsafe.Pointer(c_name))
 	defer C.free(unsafe.Pointer(c_value))
-	C.wkhtmltopdf_set_object_setting(self.s, c_name, c_value)
+
+	var i C.int
+	do(func() {
+		i = C.wkhtmltopdf_set_object_setting(self.s, c_name, c_value)
+	})
+
+	if i != C.int(1) {
+		return errors.New("wkhtml2pdf-objectsettings: set property '" + name + "' failed")
+	}
+
+	return nil
+}
+
+func (self *ObjectSettings) Get(name string) (string, error) {
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	value, ok := getSetting(func(c_value *C.char, size C.int) C.int {
+		return C.wkhtmltopdf_get_object_setting(self.s, c_name, c_value, size)
+	})
+
+	if !ok {
+		return "", errors.New("wkhtml2pdf-objectsettings: null value")
+	}
+
+	return value, nil
 }
 
 func (self *GlobalSettings) NewConverter() *Converter {
-	c := &Converter{c: C.wkhtmltopdf_create_converter(self.s)}
-	C.setup_callbacks(c.c)
+	c := &Converter{}
+
+	do(func() {
+		c.c = C.wkhtmltopdf_create_converter(self.s)
+		C.setup_callbacks(c.c)
+	})
 
 	return c
 }
 
+func registerConverter(conv *Converter) {
+	converterMu.Lock()
+	converter_map[unsafe.Pointer(conv.c)] = conv
+	converterMu.Unlock()
+}
+
+func unregisterConverter(conv *Converter) {
+	converterMu.Lock()
+	delete(converter_map, unsafe.Pointer(conv.c))
+	converterMu.Unlock()
+}
+
+// lookupConverter returns the converter being converted by c, or nil
+func lookupConverter(c unsafe.Pointer) *Converter {
+	converterMu.RLock()
+	defer converterMu.RUnlock()
+
+	return converter_map[c]
+}
+
 //export finished_cb
 func finished_cb(c unsafe.Pointer, s C.int) {
-	conv := converter_map[c]
-	if conv.Finished != nil {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Finished != nil {
 		conv.Finished(conv, int(s))
 	}
 }
 
 //export progress_changed_cb
 func progress_changed_cb(c unsafe.Pointer, p C.int) {
-	conv := converter_map[c]
-	if conv.ProgressChanged != nil {
+	conv := lookupConverter(c)
+	if conv != nil && conv.ProgressChanged != nil {
 		conv.ProgressChanged(conv, int(p))
 	}
 }
 
 //export error_cb
 func error_cb(c unsafe.Pointer, msg *C.char) {
-	conv := converter_map[c]
-	if conv.Error != nil {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Error != nil {
 		conv.Error(conv, C.GoString(msg))
 	}
 }
 
 //export warning_cb
 func warning_cb(c unsafe.Pointer, msg *C.char) {
-	conv := converter_map[c]
-	if conv.Warning != nil {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Warning != nil {
 		conv.Warning(conv, C.GoString(msg))
 	}
 }
 
 //export phase_changed_cb
 func phase_changed_cb(c unsafe.Pointer) {
-	conv := converter_map[c]
-	if conv.Phase != nil {
+	conv := lookupConverter(c)
+	if conv != nil && conv.Phase != nil {
 		conv.Phase(conv)
 	}
 }
 
+// Convert runs the conversion on the render thread.
+// Callbacks are invoked on the render thread while Convert is running.
 func (self *Converter) Convert() bool {
 
+	var ok bool
+
+	do(func() {
+		ok = self.convert()
+	})
+
+	return ok
+}
+
+// ConvertContext is like Convert, but returns ctx.Err() if ctx is done before the conversion completes.
+//
+// libwkhtmltox can't interrupt a conversion that has started, so it is abandoned instead:
+// it runs to completion on the render thread, after which the converter is destroyed and its output discarded.
+// A conversion that hasn't started when ctx is done is never started.
+// After ConvertContext returns a context error the converter belongs to this package and must not be used again.
+//
+// There's a single render thread, so an abandoned conversion keeps it busy: a page that hangs
+// blocks every later conversion. For cancellation that stops the conversion use IsolatedBackend
+// or Pool of the wkhtmltox package, which kill the child process converting it.
+func (self *Converter) ConvertContext(ctx context.Context) (bool, error) {
+
+	var ok bool
+
+	err := doContext(ctx, func() {
+		ok = self.convert()
+	})
+
+	if err != nil {
+		// queued behind the conversion, so it runs once the render thread is done with it
+		go self.Destroy()
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// convert must be called on the render thread
+func (self *Converter) convert() bool {
+
 	// To route callbacks right, we need to save a reference
 	// to the converter object, base on the pointer.
-	converter_map[unsafe.Pointer(self.c)] = self
+	registerConverter(self)
+	defer unregisterConverter(self)
+
 	status := C.wkhtmltopdf_convert(self.c)
-	delete(converter_map, unsafe.Pointer(self.c))
+
 	if status != C.int(1) {
 		return false
 	}
@@ -165,17 +590,61 @@ func (self *Converter) Convert() bool {
 }
 
 func (self *Converter) Add(settings *ObjectSettings) {
-	C.wkhtmltopdf_add_object(self.c, settings.s, nil)
+	do(func() {
+		C.wkhtmltopdf_add_object(self.c, settings.s, nil)
+	})
 }
 
 func (self *Converter) AddHtml(settings *ObjectSettings, data string) {
 	c_data := C.CString(data)
 	defer C.free(unsafe.Pointer(c_data))
-	C.wkhtmltopdf_add_object(self.c, settings.s, c_data)
+
+	do(func() {
+		C.wkhtmltopdf_add_object(self.c, settings.s, c_data)
+	})
+}
+
+// CurrentPhase returns the index of the phase the conversion is in
+func (self *Converter) CurrentPhase() int {
+	var phase C.int
+
+	do(func() {
+		phase = C.wkhtmltopdf_current_phase(self.c)
+	})
+
+	return int(phase)
+}
+
+// PhaseCount returns the number of phases the conversion goes through
+func (self *Converter) PhaseCount() int {
+	var count C.int
+
+	do(func() {
+		count = C.wkhtmltopdf_phase_count(self.c)
+	})
+
+	return int(count)
+}
+
+// PhaseDescription returns a human readable description of the phase at index
+func (self *Converter) PhaseDescription(phase int) string {
+	var desc string
+
+	do(func() {
+		desc = C.GoString(C.wkhtmltopdf_phase_description(self.c, C.int(phase)))
+	})
+
+	return desc
 }
 
 func (self *Converter) ErrorCode() int {
-	return int(C.wkhtmltopdf_http_error_code(self.c))
+	var code C.int
+
+	do(func() {
+		code = C.wkhtmltopdf_http_error_code(self.c)
+	})
+
+	return int(code)
 }
 
 // OutputAsBuffer retrieves the converted result as a byte array.
@@ -189,14 +658,33 @@ func (self *Converter) OutputAsBuffer() ([]byte, error) {
 		}
 	}
 
-	var cBuf *C.uchar
+	var buf []byte
+	ran := false
+
+	do(func() {
+		ran = true
 
-	bufLen := C.int(C.wkhtmltopdf_get_output(self.c, &cBuf))
-	buf := C.GoBytes(unsafe.Pointer(cBuf), bufLen)
+		var cBuf *C.uchar
+
+		bufLen := C.int(C.wkhtmltopdf_get_output(self.c, &cBuf))
+		buf = C.GoBytes(unsafe.Pointer(cBuf), bufLen)
+	})
+
+	if !ran {
+		return nil, ErrShutdown
+	}
 
 	return buf, nil
 }
 
+// Destroy frees the converter. Calling Destroy more than once is a no-op.
 func (self *Converter) Destroy() {
-	C.wkhtmltopdf_destroy_converter(self.c)
+	do(func() {
+		if self.destroyed {
+			return
+		}
+
+		C.wkhtmltopdf_destroy_converter(self.c)
+		self.destroyed = true
+	})
 }